@@ -0,0 +1,180 @@
+package luavm
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	//bundleManifest 脚本包清单文件, 记录每个文件的sha256
+	bundleManifest = "MANIFEST"
+	//bundleSignature 清单文件的ed25519签名
+	bundleSignature = "MANIFEST.sig"
+)
+
+var (
+	// ErrBundleSignature 脚本包清单签名校验失败
+	ErrBundleSignature = errors.New("脚本包签名校验失败")
+	// ErrBundleHash 脚本文件与清单中的sha256不一致或不在清单中
+	ErrBundleHash = errors.New("脚本文件校验失败")
+)
+
+// bundleManifestData 清单内容
+type bundleManifestData struct {
+	Files map[string]string `json:"files"` //文件路径 -> sha256
+}
+
+// BuildBundle 将root下的所有文件打包为zip写入w, 并用key对文件清单签名.
+// root一般为包含多个业务目录的脚本根目录, 如 os.DirFS("scripts")
+//
+//	f, _ := os.Create("scripts.zip")
+//	err := luavm.BuildBundle(f, os.DirFS("scripts"), privateKey)
+func BuildBundle(w io.Writer, root fs.FS, key ed25519.PrivateKey) error {
+	zw := zip.NewWriter(w)
+	manifest := bundleManifestData{Files: make(map[string]string, 64)}
+	var names []string
+	err := fs.WalkDir(root, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if name == bundleManifest || name == bundleSignature {
+			return fmt.Errorf("脚本目录中不能包含 %s", name)
+		}
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		data, err := fs.ReadFile(root, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		manifest.Files[name] = hex.EncodeToString(sum[:])
+		if err = writeZipFile(zw, name, data); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err = writeZipFile(zw, bundleManifest, data); err != nil {
+		return err
+	}
+	if err = writeZipFile(zw, bundleSignature, ed25519.Sign(key, data)); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func writeZipFile(zw *zip.Writer, name string, data []byte) error {
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+// bundleFS 已校验签名的脚本包, 打开文件时校验sha256
+type bundleFS struct {
+	zr     *zip.Reader
+	hashes map[string]string
+}
+
+// OpenBundle 打开BuildBundle生成的脚本包并用pub校验清单签名,
+// 返回的fs.FS在读取文件时校验sha256, 不在清单中或内容被修改的文件无法打开
+func OpenBundle(r io.ReaderAt, size int64, pub ed25519.PublicKey) (fs.FS, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	data, err := fs.ReadFile(zr, bundleManifest)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBundleSignature, err)
+	}
+	sig, err := fs.ReadFile(zr, bundleSignature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBundleSignature, err)
+	}
+	if !ed25519.Verify(pub, data, sig) {
+		return nil, ErrBundleSignature
+	}
+	var manifest bundleManifestData
+	if err = json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("解析脚本包清单失败: %v", err)
+	}
+	return &bundleFS{zr: zr, hashes: manifest.Files}, nil
+}
+
+// LoadBundle 读取脚本包文件, 校验通过后作为脚本根目录, 同SetFS需要在取出虚拟机之前调用.
+// require、dofile、loadfile都从脚本包中加载, io、os库仍可以读取磁盘上的文件,
+// 需要时通过[Sandbox]关闭
+func (pl *LuaPool) LoadBundle(file string, pub ed25519.PublicKey) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	fsys, err := OpenBundle(bytes.NewReader(data), int64(len(data)), pub)
+	if err != nil {
+		return err
+	}
+	pl.SetFS(fsys)
+	return nil
+}
+
+func (b *bundleFS) Open(name string) (fs.File, error) {
+	f, err := b.zr.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return f, err
+	}
+	defer f.Close()
+
+	want, ok := b.hashes[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: ErrBundleHash}
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != want {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: ErrBundleHash}
+	}
+	return &bundleFile{Reader: bytes.NewReader(data), info: info}, nil
+}
+
+// Stat 只返回文件信息, 内容在Open时校验
+func (b *bundleFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(b.zr, name)
+}
+
+// bundleFile 校验通过的文件内容
+type bundleFile struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (f *bundleFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *bundleFile) Close() error               { return nil }
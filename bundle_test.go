@@ -0,0 +1,118 @@
+package luavm
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestBundle(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := fstest.MapFS{
+		"app/util.lua":    {Data: []byte(`return {value = 3}`)},
+		"app/t1/main.lua": {Data: []byte(`easy.result = require("util").value`)},
+		"app/t3/main.lua": {Data: []byte(`easy.result = dofile("app/extra.lua")`)},
+	}
+	var buf bytes.Buffer
+	if err := BuildBundle(&buf, root, key); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys, err := OpenBundle(bytes.NewReader(buf.Bytes()), int64(buf.Len()), pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := NewLuaPool()
+	pool.SetFS(fsys)
+	vm := pool.Get()
+	if err := vm.DoFile("app", "t1"); err != nil {
+		t.Fatal(err)
+	}
+	if ret := vm.GetEasyAttr("result"); ret != lua.LNumber(3) {
+		t.Fatalf("脚本返回不符[%v]", ret)
+	}
+	pool.Put(vm)
+
+	//其他公钥校验失败
+	other, _, _ := ed25519.GenerateKey(nil)
+	if _, err := OpenBundle(bytes.NewReader(buf.Bytes()), int64(buf.Len()), other); !errors.Is(err, ErrBundleSignature) {
+		t.Fatalf("签名校验未失败 %v", err)
+	}
+
+	//修改脚本内容并加入清单之外的文件
+	tampered := rewriteZip(t, buf.Bytes(), map[string]string{
+		"app/util.lua":    `return {value = 4}`,
+		"app/t2/main.lua": `easy.result = 5`,
+		"app/extra.lua":   `return 6`,
+	})
+	fsys, err = OpenBundle(bytes.NewReader(tampered), int64(len(tampered)), pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool = NewLuaPool()
+	pool.SetFS(fsys)
+	for _, trancode := range []string{"t1", "t2"} {
+		vm = pool.Get()
+		err := vm.DoFile("app", trancode)
+		pool.Put(vm)
+		if err == nil {
+			t.Fatalf("%s 被修改的脚本仍可执行", trancode)
+		}
+	}
+	//已签名的脚本不能通过dofile执行清单之外的文件
+	vm = pool.Get()
+	err = vm.DoFile("app", "t3")
+	pool.Put(vm)
+	if err == nil || !strings.Contains(err.Error(), ErrBundleHash.Error()) {
+		t.Fatalf("dofile执行了清单之外的文件 %v", err)
+	}
+	if _, err := fsys.Open("app/t2/main.lua"); !errors.Is(err, ErrBundleHash) {
+		t.Fatalf("清单之外的文件可以打开 %v", err)
+	}
+}
+
+// rewriteZip 替换或新增zip中的文件, 其余文件保持不变
+func rewriteZip(t *testing.T, data []byte, files map[string]string) []byte {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range zr.File {
+		content, ok := files[f.Name]
+		if ok {
+			delete(files, f.Name)
+		} else {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(rc)
+			rc.Close()
+			content = string(b)
+		}
+		if err := writeZipFile(zw, f.Name, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range files {
+		if err := writeZipFile(zw, name, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -1,8 +1,8 @@
 package luavm
 
 import (
+	"context"
 	"database/sql"
-	"strconv"
 	"sync"
 
 	"github.com/yuin/gopher-lua"
@@ -18,6 +18,7 @@ const (
 //Cache ...
 type Cache struct {
 	db    *sql.DB
+	conv  *columnConverter
 	locks [segmentCount]sync.Mutex
 	segs  [segmentCount]*segment
 }
@@ -26,6 +27,7 @@ type Cache struct {
 func NewCache(db *sql.DB) *Cache {
 	c := new(Cache)
 	c.db = db
+	c.conv = newColumnConverter(nil, nil)
 	for i := range c.segs {
 		c.segs[i] = newsegment()
 	}
@@ -48,8 +50,8 @@ func (cache *Cache) get(key string) (value *lua.LTable, err error) {
 	return cache.segs[segID].get(key)
 }
 
-func (cache *Cache) getMysqlData(sqlCommand string) (value *lua.LTable, err error) {
-	rows, err := cache.db.Query(sqlCommand)
+func (cache *Cache) getMysqlData(ctx context.Context, sqlCommand string) (value *lua.LTable, err error) {
+	rows, err := cache.db.QueryContext(ctx, sqlCommand)
 	if err != nil {
 		return
 	}
@@ -73,42 +75,33 @@ func (cache *Cache) getMysqlData(sqlCommand string) (value *lua.LTable, err erro
 	index := 0
 	var table *lua.LTable
 	for rows.Next() {
-		if err = rows.Scan(m...); err != nil {
+		if err = scanRow(rows, m, values); err != nil {
 			return
 		}
 		index++
 		table = L.NewTable()
 		L.SetField(table, "_rowNo", lua.LNumber(index))
-		for i := range values {
-			switch cols[i].DatabaseTypeName() {
-			case "INT", "BIGINT", "FLOAT", "DOUBLE":
-				val, err := strconv.ParseFloat(string(values[i]), 64)
-				if err != nil {
-					return nil, err
-				}
-				L.SetField(table, cols[i].Name(), lua.LNumber(val))
-			default:
-				L.SetField(table, cols[i].Name(), lua.LString(string(values[i])))
-			}
+		if err = cache.conv.row(table, cols, values); err != nil {
+			return nil, err
 		}
 		L.RawSetInt(value, index, table)
 	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
 	if index == 1 && table != nil {
 		value = table
 	}
-	if rows.Err() != nil {
-		return
-	}
 	return
 }
 
-func (cache *Cache) queryCache(key, cmd string, expire int) (value *lua.LTable, err error) {
+func (cache *Cache) queryCache(ctx context.Context, key, cmd string, expire int) (value *lua.LTable, err error) {
 	value, err = cache.get(key)
 	if err == nil || err != errNotFound && err != errExpired {
 		return
 	}
 	//如果返回过期或者不存在则读取数据库数据
-	value, err = cache.getMysqlData(cmd)
+	value, err = cache.getMysqlData(ctx, cmd)
 	if err != nil {
 		return
 	}
@@ -121,7 +114,12 @@ func (cache *Cache) queryCache(key, cmd string, expire int) (value *lua.LTable,
 
 //QueryCache expire过期时间,单位为秒
 func (cache *Cache) QueryCache(path, cmd string, expire int) (value *lua.LTable, err error) {
-	return cache.queryCache(path, cmd, expire)
+	return cache.queryCache(context.Background(), path, cmd, expire)
+}
+
+//QueryCacheContext 同QueryCache, 缓存失效时使用ctx查询数据库
+func (cache *Cache) QueryCacheContext(ctx context.Context, path, cmd string, expire int) (value *lua.LTable, err error) {
+	return cache.queryCache(ctx, path, cmd, expire)
 }
 
 //Destory 清空所以缓存
@@ -22,8 +22,9 @@ func TestMysqlCache(t *testing.T) {
 			DataBase: "test",
 		},
 	}
-	my := newLuaMySQL()
-	if err := my.Init(conf); err != nil {
+	my := newLuaSQL(MYSQL)
+	my.confs = conf
+	if err := my.Init(); err != nil {
 		t.Fatal(err)
 	}
 	vm.PreLoadModule("mysql", my.Loader)
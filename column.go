@@ -0,0 +1,245 @@
+package luavm
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"luavm/internal/number"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// ColumnType 查询结果中字段转换为lua值的方式
+type ColumnType int
+
+const (
+	// ColumnText 原样返回字符串
+	ColumnText ColumnType = iota
+	// ColumnInt 整数, 超过2^53时为int64
+	ColumnInt
+	// ColumnFloat 浮点数
+	ColumnFloat
+	// ColumnDecimal 定点数, 转换为浮点数会丢失精度时为decimal
+	ColumnDecimal
+	// ColumnBool 布尔值, 支持1/0、true/false以及单字节的0x01/0x00
+	ColumnBool
+	// ColumnBit 按大端序读取的无符号整数, 如mysql的BIT(n)
+	ColumnBit
+	// ColumnTime 日期时间, 按配置返回ISO 8601字符串或unix时间戳
+	ColumnTime
+	// ColumnBinary 二进制数据, 作为lua字符串原样返回
+	ColumnBinary
+)
+
+// columnBitBool 不带长度的BIT, 多数数据库中为布尔值, 但也可能是BIT(n).
+// 单字节的0/1或可以解析为布尔值时为布尔值, 否则同ColumnBit
+const columnBitBool ColumnType = -1
+
+// commonColumnTypes 各数据库通用的类型名, 方言中没有定义的类型从这里查找
+var commonColumnTypes = map[string]ColumnType{
+	"TINYINT":          ColumnInt,
+	"SMALLINT":         ColumnInt,
+	"MEDIUMINT":        ColumnInt,
+	"INT":              ColumnInt,
+	"INTEGER":          ColumnInt,
+	"BIGINT":           ColumnInt,
+	"YEAR":             ColumnInt,
+	"FLOAT":            ColumnFloat,
+	"DOUBLE":           ColumnFloat,
+	"DOUBLE PRECISION": ColumnFloat,
+	"REAL":             ColumnFloat,
+	"DECIMAL":          ColumnDecimal,
+	"NUMERIC":          ColumnDecimal,
+	"MONEY":            ColumnDecimal,
+	"SMALLMONEY":       ColumnDecimal,
+	"BIT":              columnBitBool,
+	"BOOL":             ColumnBool,
+	"BOOLEAN":          ColumnBool,
+	"DATE":             ColumnTime,
+	"DATETIME":         ColumnTime,
+	"DATETIME2":        ColumnTime,
+	"SMALLDATETIME":    ColumnTime,
+	"DATETIMEOFFSET":   ColumnTime,
+	"TIMESTAMP":        ColumnTime,
+	"BINARY":           ColumnBinary,
+	"VARBINARY":        ColumnBinary,
+	"IMAGE":            ColumnBinary,
+	"BLOB":             ColumnBinary,
+	"TINYBLOB":         ColumnBinary,
+	"MEDIUMBLOB":       ColumnBinary,
+	"LONGBLOB":         ColumnBinary,
+}
+
+// lookupColumn 先在方言自己的types中查找, 再查找通用类型, 都没有时为ColumnText.
+// 类型名忽略大小写、UNSIGNED前缀以及括号中的长度精度, 通用类型中的BIT(1)为布尔值, BIT(n)为整数
+func lookupColumn(types map[string]ColumnType, dbType string) ColumnType {
+	name, size := strings.ToUpper(strings.TrimSpace(dbType)), ""
+	if i := strings.IndexByte(name, '('); i >= 0 {
+		name, size = strings.TrimSpace(name[:i]), strings.Trim(name[i:], "() ")
+	}
+	name = strings.TrimPrefix(name, "UNSIGNED ")
+	if t, ok := types[name]; ok {
+		return t
+	}
+	t := commonColumnTypes[name]
+	if t == columnBitBool && size != "" {
+		if size == "1" {
+			return ColumnBool
+		}
+		return ColumnBit
+	}
+	return t
+}
+
+// nullValue sqlNull的值, 用于与其他userdata区分
+type nullValue struct{}
+
+// sqlNull 查询结果中的NULL, 脚本中通过 mysql.null 等比较, 也可以作为参数和fmt系列函数的值.
+// 只读且不属于任何虚拟机, 没有元表, 因此可以放在虚拟机间共享的缓存中
+var sqlNull = &lua.LUserData{
+	Value:     nullValue{},
+	Env:       &lua.LTable{Metatable: lua.LNil},
+	Metatable: lua.LNil,
+}
+
+// timeLayouts 驱动返回的日期时间格式, iso为空时输出带时区的RFC3339
+var timeLayouts = []struct {
+	layout string
+	iso    string
+}{
+	{time.RFC3339Nano, ""},
+	{"2006-01-02 15:04:05.999999999Z07:00", ""},
+	{"2006-01-02T15:04:05.999999999", "2006-01-02T15:04:05.999999999"},
+	{"2006-01-02 15:04:05.999999999", "2006-01-02T15:04:05.999999999"},
+	{"2006-01-02", "2006-01-02"},
+}
+
+// columnConverter 按方言和[[SQL]]的Null、Time配置转换查询结果
+type columnConverter struct {
+	d        Dialect
+	omitNull bool
+	epoch    bool
+}
+
+// newColumnConverter d为nil时只使用通用类型, c为nil时使用默认配置
+func newColumnConverter(d Dialect, c *sqlConfig) *columnConverter {
+	conv := &columnConverter{d: d}
+	if c != nil {
+		conv.omitNull = c.Null == "omit"
+		conv.epoch = c.Time == "epoch"
+	}
+	return conv
+}
+
+func (c *columnConverter) columnType(dbType string) ColumnType {
+	if c.d == nil {
+		return lookupColumn(nil, dbType)
+	}
+	return c.d.ColumnType(dbType)
+}
+
+// scanRow 读取一行. RawBytes为nil表示NULL, 而目标为nil时空字符串也会得到nil,
+// 所以扫描前先全部置为非nil
+func scanRow(rows *sql.Rows, dest []interface{}, values []sql.RawBytes) error {
+	for i := range values {
+		values[i] = sql.RawBytes{}
+	}
+	return rows.Scan(dest...)
+}
+
+// row 将一行数据转换后写入table, 配置为omit时NULL字段不写入
+func (c *columnConverter) row(table *lua.LTable, cols []*sql.ColumnType, values []sql.RawBytes) error {
+	for i, col := range cols {
+		v, err := c.value(c.columnType(col.DatabaseTypeName()), values[i])
+		if err != nil {
+			return fmt.Errorf("字段[%s]: %v", col.Name(), err)
+		}
+		if v != nil {
+			table.RawSetString(col.Name(), v)
+		}
+	}
+	return nil
+}
+
+func (c *columnConverter) value(typ ColumnType, b sql.RawBytes) (lua.LValue, error) {
+	if b == nil {
+		if c.omitNull {
+			return nil, nil
+		}
+		return sqlNull, nil
+	}
+	s := string(b)
+	switch typ {
+	case ColumnInt:
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return number.FromInt64(n), nil
+		}
+		if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+			return number.FromUint64(n), nil
+		}
+		return number.FromString(s)
+	case ColumnFloat:
+		return parseNumber(s)
+	case ColumnDecimal:
+		return number.FromString(s)
+	case ColumnBool:
+		if len(b) == 1 && b[0] <= 1 {
+			return lua.LBool(b[0] == 1), nil
+		}
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, err
+		}
+		return lua.LBool(v), nil
+	case columnBitBool:
+		if len(b) == 1 && b[0] <= 1 {
+			return lua.LBool(b[0] == 1), nil
+		}
+		if v, err := strconv.ParseBool(s); err == nil {
+			return lua.LBool(v), nil
+		}
+		fallthrough
+	case ColumnBit:
+		if len(b) > 8 {
+			return nil, fmt.Errorf("BIT长度超过64位[%d]", len(b)*8)
+		}
+		var n uint64
+		for _, x := range b {
+			n = n<<8 | uint64(x)
+		}
+		return number.FromUint64(n), nil
+	case ColumnTime:
+		return c.time(s), nil
+	}
+	return lua.LString(s), nil
+}
+
+func parseNumber(s string) (lua.LValue, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, err
+	}
+	return lua.LNumber(f), nil
+}
+
+// time 不带时区的时间按UTC计算时间戳, 无法识别的格式原样返回
+func (c *columnConverter) time(s string) lua.LValue {
+	for _, l := range timeLayouts {
+		t, err := time.Parse(l.layout, s)
+		if err != nil {
+			continue
+		}
+		if c.epoch {
+			//UnixNano只能表示1678年到2262年
+			return lua.LNumber(float64(t.Unix()) + float64(t.Nanosecond())/1e9)
+		}
+		if l.iso == "" {
+			return lua.LString(t.Format(time.RFC3339Nano))
+		}
+		return lua.LString(t.Format(l.iso))
+	}
+	return lua.LString(s)
+}
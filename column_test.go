@@ -0,0 +1,187 @@
+package luavm
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"luavm/internal/number"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestSQLColumnTypes(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "test.db")
+	conf := fmt.Sprintf(`
+[[SQL]]
+Name = "iso"
+Type = "sqlite"
+Addr = %[1]q
+
+[[SQL]]
+Name = "epoch"
+Type = "sqlite"
+Addr = %[1]q
+Null = "omit"
+Time = "epoch"
+`, addr)
+	pool := NewLuaPool()
+	if err := pool.InitFromConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Shutdown(context.Background())
+
+	vm := pool.Get()
+	defer pool.Put(vm)
+	script := `
+		local sqlite = require("sqlite")
+		local conn = sqlite.connect("iso")
+		conn.begin()
+		conn.exec([[create table t (id integer, price decimal(10,2), flag boolean, tiny tinyint,
+			created datetime, data blob, name text, note text, amount int)]])
+		local ret, err = conn.exec("insert into t values (?, ?, ?, ?, ?, x'00ff', ?, null, null)",
+			1, "12.5", 1, 3, "2024-01-02 03:04:05", "")
+		if(ret == nil) then
+			error(err)
+		end
+		conn.commit()
+
+		local row, err = conn.queryRow("select * from t")
+		if(row == nil) then
+			error(err)
+		end
+		assert(row.id == 1 and row.price == 12.5 and row.flag == true and row.tiny == 3, "数值类型不符")
+		assert(row.created == "2024-01-02T03:04:05Z", "日期不符 " .. tostring(row.created))
+		assert(row.data == "\0\255", "二进制不符")
+		assert(row.name == "", "空字符串不符")
+		assert(row.note == sqlite.null and row.amount == sqlite.null, "NULL不符")
+
+		local rows = sqlite.connect("epoch").query("select * from t")
+		assert(rows[1].created == 1704164645, "时间戳不符 " .. tostring(rows[1].created))
+		assert(rows[1].note == nil and rows[1].amount == nil, "NULL未省略")
+		assert(rows[1].name == "", "空字符串被省略")
+	`
+	if _, _, err := vm.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestColumnConvert(t *testing.T) {
+	conv := newColumnConverter(getDialect(MYSQL), nil)
+	cases := []struct {
+		dbType string
+		raw    string
+		want   lua.LValue
+	}{
+		{"UNSIGNED INT", "4294967295", lua.LNumber(4294967295)},
+		{"BIT", "\x01\x02", lua.LNumber(258)},
+		{"DECIMAL", "0.10", lua.LNumber(0.1)},
+		{"SMALLINT", "-3", lua.LNumber(-3)},
+		{"DATETIME", "2024-01-02 03:04:05.5", lua.LString("2024-01-02T03:04:05.5")},
+		{"DATE", "2024-01-02", lua.LString("2024-01-02")},
+		{"DATETIME", "0000-00-00 00:00:00", lua.LString("0000-00-00 00:00:00")},
+		{"VARCHAR", "abc", lua.LString("abc")},
+	}
+	for _, c := range cases {
+		got, err := conv.value(conv.columnType(c.dbType), []byte(c.raw))
+		if err != nil || got != c.want {
+			t.Errorf("%s[%q] 得到 %v %v, 期望 %v", c.dbType, c.raw, got, err, c.want)
+		}
+	}
+	if got, _ := conv.value(ColumnInt, nil); got != sqlNull {
+		t.Errorf("NULL 得到 %v", got)
+	}
+
+	//BIT(1)或单字节的0/1为布尔值, 多位的BIT为整数
+	conv = newColumnConverter(getDialect(MSSQL), &sqlConfig{Time: "epoch"})
+	for _, c := range []struct {
+		dbType string
+		raw    string
+		want   lua.LValue
+	}{
+		{"BIT", "\x01", lua.LTrue},
+		{"BIT", "false", lua.LFalse},
+		{"BIT", "\x01\x02", lua.LNumber(258)},
+		{"BIT(1)", "\x00", lua.LFalse},
+		{"BIT(8)", "\x01", lua.LNumber(1)},
+		{"DATE", "0001-01-01", lua.LNumber(-62135596800)},
+		{"DATETIME", "9999-12-31 23:59:59.5", lua.LNumber(253402300799.5)},
+	} {
+		got, err := conv.value(conv.columnType(c.dbType), []byte(c.raw))
+		if err != nil || got != c.want {
+			t.Errorf("%s[%q] 得到 %v %v, 期望 %v", c.dbType, c.raw, got, err, c.want)
+		}
+	}
+
+	//超出精度的整数为int64, 而不是报错
+	got, err := conv.value(ColumnInt, []byte("9007199254740993"))
+	if s, _ := number.String(got); err != nil || s != "9007199254740993" {
+		t.Errorf("INT超出精度 得到 %v %v", got, err)
+	}
+
+	//COUNT(*)为BIGINT, SUM()为DECIMAL, 可以精确表示时与lua数值直接比较
+	L := lua.NewState()
+	defer L.Close()
+	for name, c := range map[string][2]string{"n": {"BIGINT", "0"}, "total": {"DECIMAL", "12.50"}} {
+		got, err := conv.value(conv.columnType(c[0]), []byte(c[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		L.SetGlobal(name, got)
+	}
+	if err := L.DoString(`assert(n == 0 and total > 10 and total == 12.5)`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLNumber(t *testing.T) {
+	conf := fmt.Sprintf(`
+[[SQL]]
+Name = "main"
+Type = "sqlite"
+Addr = %q
+`, filepath.Join(t.TempDir(), "test.db"))
+	pool := NewLuaPool()
+	if err := pool.InitFromConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Shutdown(context.Background())
+
+	vm := pool.Get()
+	defer pool.Put(vm)
+	script := `
+		local number = require("number")
+		local sqlite = require("sqlite")
+		local conn = sqlite.connect("main")
+		conn.begin()
+		conn.exec("create table t (id bigint, price decimal(30,20), rate double, note text)")
+		local id = number.int64("9007199254740993")
+		local ret, err = conn.exec("insert into t values (?, ?, ?, ?)",
+			id, number.decimal("0.10000000000000000001"), 1.5, sqlite.null)
+		if(ret == nil) then
+			error(err)
+		end
+		conn.commit()
+		local row, err = conn.queryRow("select * from t where id = ?", id)
+		if(row == nil) then
+			error(err)
+		end
+		assert(row.id == id and number.type(row.id) == "int64", "int64不符 " .. tostring(row.id))
+		assert(row.rate == 1.5 and row.note == sqlite.null)
+		local sql = conn.fmtInsert("t", {id = id + 1})
+		assert(sql == "insert into` + "`t`(`id`)" + ` values( 9007199254740994 )", sql)
+		sql = conn.fmtInsert("t", {note = sqlite.null})
+		assert(sql == "insert into` + "`t`(`note`)" + ` values( NULL )", sql)
+		sql = conn.fmtUpdate("t", {note = sqlite.null}, {price = sqlite.null})
+		assert(sql == "update ` + "`t`" + ` set  ` + "`note`" + ` = NULL   where  ` + "`price`" + ` is NULL ", sql)
+		result = {id = row.id}
+	`
+	if _, _, err := vm.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+	var out struct{ ID int64 }
+	if err := mapResult(vm.l.GetGlobal("result"), &out); err != nil || out.ID != 9007199254740993 {
+		t.Fatalf("映射int64不符 %+v %v", out, err)
+	}
+}
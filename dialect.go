@@ -0,0 +1,236 @@
+package luavm
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Dialect 数据库方言, SQL插件按方言建立连接, fmt*系列函数按方言生成语句.
+// 每个注册的方言对应一个插件, 脚本中 require(name) 加载, [[SQL]]中 Type = name
+type Dialect interface {
+	// Driver database/sql中注册的驱动名
+	Driver() string
+	// DSN 根据[[SQL]]的配置生成连接串
+	DSN(c DSNConfig) (string, error)
+	// Quote 引用标识符(表名、字段名)
+	Quote(name string) string
+	// Escape 转义字符串字面量中的单引号, 结果不含两侧的引号
+	Escape(s string) string
+	// Bool 布尔字面量
+	Bool(b bool) string
+	// Limit 分页子句, offset为0时可省略offset部分
+	Limit(limit, offset int) string
+	// Placeholder 第n个参数的占位符, n从1开始
+	Placeholder(n int) string
+	// ColumnType 查询结果中DatabaseTypeName为dbType的字段的转换方式
+	ColumnType(dbType string) ColumnType
+}
+
+// DSNConfig [[SQL]]中与建立连接相关的配置
+type DSNConfig struct {
+	Name     string
+	Addr     string
+	User     string
+	Passwd   string
+	DataBase string
+	Params   string
+}
+
+var (
+	dialectsMu sync.RWMutex
+	dialects   = make(map[string]Dialect)
+)
+
+// RegisterDialect 注册数据库方言, 名称重复或d为nil时panic.
+// 需要在NewLuaPool之前调用, 一般放在init中
+func RegisterDialect(name string, d Dialect) {
+	dialectsMu.Lock()
+	defer dialectsMu.Unlock()
+	if d == nil {
+		panic("luavm: RegisterDialect dialect is nil")
+	}
+	if _, ok := dialects[name]; ok {
+		panic("luavm: RegisterDialect called twice for dialect " + name)
+	}
+	dialects[name] = d
+}
+
+func getDialect(name string) Dialect {
+	dialectsMu.RLock()
+	defer dialectsMu.RUnlock()
+	return dialects[name]
+}
+
+// dialectNames 已注册的方言, 按名称排序
+func dialectNames() []string {
+	dialectsMu.RLock()
+	defer dialectsMu.RUnlock()
+	names := make([]string, 0, len(dialects))
+	for name := range dialects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterDialect(MYSQL, mysqlDialect{})
+	RegisterDialect(MSSQL, mssqlDialect{})
+	RegisterDialect(SQLITE, sqliteDialect{})
+	RegisterDialect(POSTGRES, postgresDialect{})
+}
+
+// parseParams 解析Params, 格式错误时记录日志并忽略
+func parseParams(c DSNConfig) url.Values {
+	qs, err := url.ParseQuery(c.Params)
+	if err != nil {
+		log.Printf("luaSQL ParseQuery [%v] error, ERR: %v\n", c.Params, err.Error())
+		qs = url.Values{}
+	}
+	return qs
+}
+
+// limitOffset limit n offset m 形式的分页
+func limitOffset(limit, offset int) string {
+	if offset > 0 {
+		return fmt.Sprintf("limit %d offset %d", limit, offset)
+	}
+	return fmt.Sprintf("limit %d", limit)
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Driver() string { return "mysql" }
+
+func (mysqlDialect) DSN(c DSNConfig) (string, error) {
+	qs := parseParams(c)
+	if qs.Get("charset") == "" {
+		qs.Add("charset", "utf8")
+	}
+	if qs.Get("multiStatements") == "" {
+		qs.Add("multiStatements", "true")
+	}
+	return fmt.Sprintf("%s:%s@tcp(%s)/%s?%s",
+		c.User, c.Passwd, c.Addr, c.DataBase, qs.Encode()), nil
+}
+
+func (mysqlDialect) Quote(name string) string    { return "`" + name + "`" }
+func (mysqlDialect) Escape(s string) string      { return escapeQuote('\\', s) }
+func (mysqlDialect) Bool(b bool) string          { return strconv.FormatBool(b) }
+func (mysqlDialect) Limit(limit, off int) string { return limitOffset(limit, off) }
+func (mysqlDialect) Placeholder(n int) string    { return "?" }
+
+// mysql的BIT(n)为位串
+var mysqlColumnTypes = map[string]ColumnType{"BIT": ColumnBit}
+
+func (mysqlDialect) ColumnType(dbType string) ColumnType {
+	return lookupColumn(mysqlColumnTypes, dbType)
+}
+
+type mssqlDialect struct{}
+
+func (mssqlDialect) Driver() string { return "mssql" }
+
+func (mssqlDialect) DSN(c DSNConfig) (string, error) {
+	qs := parseParams(c)
+	if qs.Get("connection+timeout") == "" {
+		qs.Add("connection+timeout", "30")
+	}
+	if qs.Get("encrypt") == "" {
+		qs.Add("encrypt", "disable")
+	}
+	if qs.Get("database") == "" {
+		qs.Add("database", c.DataBase)
+	}
+	u := &url.URL{
+		Scheme:   "sqlserver",
+		User:     url.UserPassword(c.User, c.Passwd),
+		Host:     c.Addr,
+		RawQuery: qs.Encode(),
+	}
+	return u.String(), nil
+}
+
+func (mssqlDialect) Quote(name string) string { return "[" + name + "]" }
+func (mssqlDialect) Escape(s string) string   { return escapeQuote('\'', s) }
+
+func (mssqlDialect) Bool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// Limit 需要与order by一起使用
+func (mssqlDialect) Limit(limit, offset int) string {
+	return fmt.Sprintf("offset %d rows fetch next %d rows only", offset, limit)
+}
+
+func (mssqlDialect) Placeholder(n int) string { return "?" }
+
+func (mssqlDialect) ColumnType(dbType string) ColumnType { return lookupColumn(nil, dbType) }
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Driver() string                  { return "sqlite3" }
+func (sqliteDialect) DSN(c DSNConfig) (string, error) { return c.Addr, nil }
+func (sqliteDialect) Quote(name string) string        { return "`" + name + "`" }
+func (sqliteDialect) Escape(s string) string          { return escapeQuote('\\', s) }
+func (sqliteDialect) Bool(b bool) string              { return strconv.FormatBool(b) }
+func (sqliteDialect) Limit(limit, off int) string     { return limitOffset(limit, off) }
+func (sqliteDialect) Placeholder(n int) string        { return "?" }
+
+func (sqliteDialect) ColumnType(dbType string) ColumnType { return lookupColumn(nil, dbType) }
+
+// postgresDialect 驱动需由使用方引入并注册为postgres, 如 github.com/lib/pq
+type postgresDialect struct{}
+
+func (postgresDialect) Driver() string { return "postgres" }
+
+func (postgresDialect) DSN(c DSNConfig) (string, error) {
+	qs := parseParams(c)
+	if qs.Get("sslmode") == "" {
+		qs.Add("sslmode", "disable")
+	}
+	u := &url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(c.User, c.Passwd),
+		Host:     c.Addr,
+		Path:     "/" + c.DataBase,
+		RawQuery: qs.Encode(),
+	}
+	return u.String(), nil
+}
+
+func (postgresDialect) Quote(name string) string    { return `"` + name + `"` }
+func (postgresDialect) Escape(s string) string      { return escapeQuote('\'', s) }
+func (postgresDialect) Limit(limit, off int) string { return limitOffset(limit, off) }
+func (postgresDialect) Placeholder(n int) string    { return "$" + strconv.Itoa(n) }
+
+// postgres的BIT为'0101'形式的位串, 原样返回
+var postgresColumnTypes = map[string]ColumnType{
+	"INT2":        ColumnInt,
+	"INT4":        ColumnInt,
+	"INT8":        ColumnInt,
+	"FLOAT4":      ColumnFloat,
+	"FLOAT8":      ColumnFloat,
+	"TIMESTAMPTZ": ColumnTime,
+	"BYTEA":       ColumnBinary,
+	"BIT":         ColumnText,
+	"VARBIT":      ColumnText,
+}
+
+func (postgresDialect) ColumnType(dbType string) ColumnType {
+	return lookupColumn(postgresColumnTypes, dbType)
+}
+
+func (postgresDialect) Bool(b bool) string {
+	if b {
+		return "TRUE"
+	}
+	return "FALSE"
+}
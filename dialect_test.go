@@ -0,0 +1,75 @@
+package luavm
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// testDialect 使用sqlite驱动, 标识符用双引号, 占位符为?1,?2...
+type testDialect struct{ sqliteDialect }
+
+func (testDialect) Quote(name string) string { return `"` + name + `"` }
+func (testDialect) Placeholder(n int) string { return "?" + strconv.Itoa(n) }
+
+// testDialectSeq 方言注册后无法移除, 每次运行使用不同的名称, 使-count=N时不会重复注册
+var testDialectSeq int32
+
+func TestRegisterDialect(t *testing.T) {
+	name := fmt.Sprintf("testdb%d", atomic.AddInt32(&testDialectSeq, 1))
+	RegisterDialect(name, testDialect{})
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("重复注册方言未panic")
+			}
+		}()
+		RegisterDialect(name, testDialect{})
+	}()
+
+	conf := fmt.Sprintf(`
+[[SQL]]
+Name = "main"
+Type = %q
+Addr = %q
+`, name, filepath.Join(t.TempDir(), "test.db"))
+	pool := NewLuaPool()
+	if err := pool.InitFromConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Shutdown(context.Background())
+
+	vm := pool.Get()
+	defer pool.Put(vm)
+	script := `
+		local conn, err = require("` + name + `").connect("main")
+		if(conn == nil) then
+			error(err)
+		end
+		conn.begin()
+		conn.exec("create table user (name text, age int)")
+		ret, err = conn.exec("insert into user values (?, ?)", "lisi", 25)
+		if(ret == nil) then
+			error(err)
+		end
+		conn.commit()
+		local row, err = conn.queryRow("select * from user where name = ?", "lisi")
+		if(row == nil) then
+			error(err)
+		end
+		if(row.age ~= 25) then
+			error("queryRow 不符")
+		end
+		return conn.fmtInsert("user", {ok = true}) .. " " .. conn.fmtLimit(10, 20)
+	`
+	errNo, _, err := vm.DoString(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `insert into"user"("ok") values( true ) limit 10 offset 20`; errNo != want {
+		t.Fatalf("生成的语句不符\n得到 %q\n期望 %q", errNo, want)
+	}
+}
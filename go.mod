@@ -8,7 +8,9 @@ require (
 	github.com/denisenkom/go-mssqldb v0.12.3
 	github.com/garyburd/redigo v1.6.4
 	github.com/go-sql-driver/mysql v1.8.1
+	github.com/lib/pq v1.12.3
 	github.com/mattn/go-sqlite3 v1.14.24
+	github.com/mitchellh/mapstructure v1.5.0
 	github.com/yireyun/go_context v0.0.0-20180624025842-9a7f76f87879
 	github.com/yuin/gluamapper v0.0.0-20150323120927-d836955830e7
 	github.com/yuin/gopher-lua v1.1.1
@@ -20,6 +22,5 @@ require (
 	filippo.io/edwards25519 v1.1.0 // indirect
 	github.com/golang-sql/civil v0.0.0-20190719163853-cb61b32ac6fe // indirect
 	github.com/golang-sql/sqlexp v0.1.0 // indirect
-	github.com/mitchellh/mapstructure v1.5.0 // indirect
 	golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d // indirect
 )
@@ -0,0 +1,81 @@
+package luavm
+
+import (
+	"fmt"
+)
+
+// poolHooks 虚拟机池的回调函数
+type poolHooks struct {
+	onCreate []func(*LuaVM) error
+	onGet    []func(*LuaVM) error
+	onPut    []func(*LuaVM) error
+}
+
+// OnCreate 注册虚拟机创建后执行的函数, 在加载库和插件之后、记录全局环境之前执行,
+// 其中设置的全局变量和加载的模块在归还虚拟机时保留. 返回错误时关闭该虚拟机,
+// Get返回此错误. 需要在Init之前调用
+//
+//	luaPool.OnCreate(func(L *luavm.LuaVM) error {
+//		_, _, err := L.DoString(`helper = require("helper")`)
+//		return err
+//	})
+func (pl *LuaPool) OnCreate(fn func(*LuaVM) error) {
+	pl.m.Lock()
+	pl.hooks.onCreate = append(pl.hooks.onCreate, fn)
+	pl.m.Unlock()
+}
+
+// OnGet 注册每次取出虚拟机时执行的函数, 返回错误时关闭该虚拟机, Get返回此错误.
+// 需要在Init之前调用
+func (pl *LuaPool) OnGet(fn func(*LuaVM) error) {
+	pl.m.Lock()
+	pl.hooks.onGet = append(pl.hooks.onGet, fn)
+	pl.m.Unlock()
+}
+
+// OnPut 注册每次归还虚拟机时执行的函数, 在清理虚拟机之前执行,
+// 返回错误时关闭该虚拟机而不放回池中. 需要在Init之前调用
+func (pl *LuaPool) OnPut(fn func(*LuaVM) error) {
+	pl.m.Lock()
+	pl.hooks.onPut = append(pl.hooks.onPut, fn)
+	pl.m.Unlock()
+}
+
+// create 执行OnCreate, 回调中执行的脚本不计入虚拟机的执行次数
+func (h *poolHooks) create(L *LuaVM) error {
+	for _, fn := range h.onCreate {
+		if err := fn(L); err != nil {
+			return fmt.Errorf("初始化虚拟机失败: %w", err)
+		}
+	}
+	L.l.SetTop(0)
+	L.execs = 0
+	return nil
+}
+
+func (h *poolHooks) get(L *LuaVM) error {
+	for _, fn := range h.onGet {
+		if err := fn(L); err != nil {
+			return fmt.Errorf("取出虚拟机失败: %w", err)
+		}
+	}
+	return nil
+}
+
+func (h *poolHooks) put(L *LuaVM) error {
+	for _, fn := range h.onPut {
+		if err := fn(L); err != nil {
+			return fmt.Errorf("归还虚拟机失败: %w", err)
+		}
+	}
+	return nil
+}
+
+// checkout 执行OnGet, 失败时关闭虚拟机
+func (pl *LuaPool) checkout(L *LuaVM) (*LuaVM, error) {
+	if err := pl.hooks.get(L); err != nil {
+		pl.release(L)
+		return nil, err
+	}
+	return L, nil
+}
@@ -0,0 +1,68 @@
+package luavm
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestPoolHooks(t *testing.T) {
+	pool := NewLuaPool()
+	created, gets, puts := 0, 0, 0
+	pool.OnCreate(func(L *LuaVM) error {
+		created++
+		_, _, err := L.DoString(`helper = {greet = function(name) return "hello " .. name end}`)
+		return err
+	})
+	pool.OnGet(func(L *LuaVM) error {
+		gets++
+		return nil
+	})
+	pool.OnPut(func(L *LuaVM) error {
+		puts++
+		if L.GetGlobal("broken") != nil && L.GetGlobal("broken").String() == "true" {
+			return errors.New("broken")
+		}
+		return nil
+	})
+
+	vm := pool.Get()
+	errNo, _, err := vm.DoString(`return helper.greet("easy")`)
+	if err != nil || errNo != "hello easy" {
+		t.Fatalf("OnCreate加载的全局变量不可用[%s] %v", errNo, err)
+	}
+	pool.Put(vm)
+	//OnCreate设置的全局变量在归还后保留
+	if vm2 := pool.Get(); vm2 != vm {
+		t.Fatal("未取到归还的虚拟机")
+	}
+	if _, _, err := vm.DoString(`assert(helper.greet); broken = true`); err != nil {
+		t.Fatal(err)
+	}
+	if vm.execs != 2 {
+		t.Fatalf("OnCreate中执行的脚本计入了执行次数[%d]", vm.execs)
+	}
+	//OnPut失败的虚拟机不放回池中
+	pool.Put(vm)
+	if st := pool.Stats(); st.Idle != 0 || st.Destroyed != 1 {
+		t.Fatalf("OnPut失败的虚拟机未关闭 %+v", st)
+	}
+	if created != 1 || gets != 2 || puts != 2 {
+		t.Fatalf("回调次数不符 %d %d %d", created, gets, puts)
+	}
+
+	//OnGet/OnCreate失败时Get返回错误
+	bad := NewLuaPool()
+	bad.OnCreate(func(L *LuaVM) error { return errors.New("create") })
+	if _, err := bad.GetContext(context.Background()); err == nil {
+		t.Fatal("OnCreate失败时未返回错误")
+	}
+	bad = NewLuaPool()
+	bad.OnGet(func(L *LuaVM) error { return errors.New("get") })
+	if _, err := bad.GetContext(context.Background()); err == nil {
+		t.Fatal("OnGet失败时未返回错误")
+	}
+	if st := bad.Stats(); st.InUse != 0 || st.Created != st.Destroyed {
+		t.Fatalf("OnGet失败的虚拟机未关闭 %+v", st)
+	}
+}
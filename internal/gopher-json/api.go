@@ -1,6 +1,7 @@
 package json // import "game/luavm/internal/gopher-json"
 
 import (
+	"bytes"
 	"encoding/json"
 
 	"github.com/yuin/gopher-lua"
@@ -15,7 +16,13 @@ func apiDecode(L *lua.LState) int {
 	str := L.CheckString(1)
 
 	var value interface{}
-	err := json.Unmarshal([]byte(str), &value)
+	// numbers are decoded losslessly, see fromJSON
+	decoder := json.NewDecoder(bytes.NewReader([]byte(str)))
+	decoder.UseNumber()
+	err := decoder.Decode(&value)
+	if err == nil && len(bytes.TrimSpace([]byte(str[decoder.InputOffset():]))) > 0 {
+		err = errTrailing
+	}
 	if err != nil {
 		L.Push(lua.LNil)
 		L.Push(toLuaError(ErrJsonDecodeNo, err.Error()))
@@ -73,3 +73,20 @@ func TestCustomRequire(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestLosslessNumbers(t *testing.T) {
+	const str = `
+	local json = require("json")
+	local obj = json.decode('{"id":9007199254740993,"price":0.10000000000000000001,"n":1.5}')
+	assert(obj.n == 1.5)
+	assert(tostring(obj.id) == "9007199254740993")
+	assert(tostring(obj.price) == "0.10000000000000000001")
+	assert(json.encode({obj.id}) == "[9007199254740993]")
+	assert(json.decode("1 2") == nil)
+	`
+	s := lua.NewState()
+	Preload(s)
+	if err := s.DoString(str); err != nil {
+		t.Error(err)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"strconv"
 
+	"luavm/internal/number"
+
 	"github.com/yuin/gopher-lua"
 )
 
@@ -14,6 +16,7 @@ var (
 	errState    = errors.New("cannot encode state to JSON")
 	errUserData = errors.New("cannot encode userdata to JSON")
 	errNested   = errors.New("cannot encode recursively nested tables to JSON")
+	errTrailing = errors.New("invalid character after top-level value")
 )
 
 type jsonValue struct {
@@ -80,6 +83,11 @@ func toJSON(value lua.LValue, visited map[*lua.LTable]bool) (data []byte, err er
 			data, err = json.Marshal(arr)
 		}
 	case *lua.LUserData:
+		// int64 and decimal are encoded as plain numbers
+		if s, ok := number.String(converted); ok {
+			data = []byte(s)
+			return
+		}
 		// TODO: call metatable __tostring?
 		err = errUserData
 	}
@@ -92,6 +100,14 @@ func fromJSON(L *lua.LState, value interface{}) lua.LValue {
 		return lua.LBool(converted)
 	case float64:
 		return lua.LNumber(converted)
+	case json.Number:
+		// integers above 2^53 and decimals that do not round-trip through
+		// float64 become int64/decimal userdata
+		if v, err := number.FromString(string(converted)); err == nil {
+			return v
+		}
+		f, _ := converted.Float64()
+		return lua.LNumber(f)
 	case string:
 		return lua.LString(converted)
 	case []interface{}:
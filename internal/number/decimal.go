@@ -0,0 +1,243 @@
+package number
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// DivPrecision 除不尽时在两个操作数的小数位数之外多保留的位数
+const DivPrecision = 16
+
+// MaxExponent ParseDecimal支持的指数和小数位数的上限, 避免1e999999999之类的输入
+// 计算10的幂时占用大量内存和时间
+const MaxExponent = 1000
+
+// ErrDivByZero 除数为0
+var ErrDivByZero = errors.New("除数为0")
+
+var bigTen = big.NewInt(10)
+
+// Decimal 任意精度的十进制定点数, 值为 unscaled * 10^-scale, scale不小于0.
+// 创建后不再修改, 可以在虚拟机间共享
+type Decimal struct {
+	unscaled *big.Int
+	scale    int32
+}
+
+// ParseDecimal 解析 -12.345、1e-3 等形式的十进制数, 指数和小数位数不能超过MaxExponent
+func ParseDecimal(s string) (*Decimal, error) {
+	str := strings.TrimSpace(s)
+	mant, exp := str, 0
+	if i := strings.IndexAny(str, "eE"); i >= 0 {
+		e, err := strconv.Atoi(str[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("无效的十进制数[%s]", s)
+		}
+		if e > MaxExponent || e < -MaxExponent {
+			return nil, fmt.Errorf("指数超出范围[%s]", s)
+		}
+		mant, exp = str[:i], e
+	}
+	neg := false
+	if mant != "" && (mant[0] == '-' || mant[0] == '+') {
+		neg = mant[0] == '-'
+		mant = mant[1:]
+	}
+	intPart, frac := mant, ""
+	if i := strings.IndexByte(mant, '.'); i >= 0 {
+		intPart, frac = mant[:i], mant[i+1:]
+	}
+	digits := intPart + frac
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return nil, fmt.Errorf("无效的十进制数[%s]", s)
+	}
+	u, _ := new(big.Int).SetString(digits, 10)
+	if neg {
+		u.Neg(u)
+	}
+	scale := len(frac) - exp
+	if scale > MaxExponent {
+		return nil, fmt.Errorf("小数位数过多[%s]", s)
+	}
+	if scale < 0 {
+		u.Mul(u, pow10(-scale))
+		scale = 0
+	}
+	return &Decimal{unscaled: u, scale: int32(scale)}, nil
+}
+
+// NewDecimal 由整数创建
+func NewDecimal(n int64) *Decimal {
+	return &Decimal{unscaled: big.NewInt(n)}
+}
+
+// decimalFromFloat 按最短的十进制表示转换浮点数
+func decimalFromFloat(f float64) (*Decimal, error) {
+	return ParseDecimal(strconv.FormatFloat(f, 'f', -1, 64))
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(bigTen, big.NewInt(int64(n)), nil)
+}
+
+// rescale 返回scale位小数时的unscaled, scale不能小于d.scale
+func (d *Decimal) rescale(scale int32) *big.Int {
+	if scale == d.scale {
+		return d.unscaled
+	}
+	return new(big.Int).Mul(d.unscaled, pow10(int(scale-d.scale)))
+}
+
+func align(a, b *Decimal) (x, y *big.Int, scale int32) {
+	scale = a.scale
+	if b.scale > scale {
+		scale = b.scale
+	}
+	return a.rescale(scale), b.rescale(scale), scale
+}
+
+// Add a+b
+func (d *Decimal) Add(o *Decimal) *Decimal {
+	x, y, scale := align(d, o)
+	return &Decimal{new(big.Int).Add(x, y), scale}
+}
+
+// Sub a-b
+func (d *Decimal) Sub(o *Decimal) *Decimal {
+	x, y, scale := align(d, o)
+	return &Decimal{new(big.Int).Sub(x, y), scale}
+}
+
+// Mul a*b, 小数位数为两者之和, 超过MaxExponent时四舍五入到MaxExponent位
+func (d *Decimal) Mul(o *Decimal) *Decimal {
+	return (&Decimal{new(big.Int).Mul(d.unscaled, o.unscaled), d.scale + o.scale}).round(MaxExponent)
+}
+
+// round 小数位数超过scale时四舍五入, 远离0
+func (d *Decimal) round(scale int32) *Decimal {
+	if d.scale <= scale {
+		return d
+	}
+	div := pow10(int(d.scale - scale))
+	q, r := new(big.Int).QuoRem(d.unscaled, div, new(big.Int))
+	r.Abs(r).Lsh(r, 1)
+	if r.Cmp(div) >= 0 {
+		if d.unscaled.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return &Decimal{q, scale}
+}
+
+// Div a/b, 除不尽时多保留DivPrecision位(不超过MaxExponent)并四舍五入, 末尾的0去掉但不少于两者的小数位数
+func (d *Decimal) Div(o *Decimal) (*Decimal, error) {
+	if o.unscaled.Sign() == 0 {
+		return nil, ErrDivByZero
+	}
+	keep := d.scale
+	if o.scale > keep {
+		keep = o.scale
+	}
+	scale := keep + DivPrecision
+	if scale > MaxExponent {
+		scale = MaxExponent
+	}
+	//d.unscaled*10^(scale+o.scale-d.scale) / o.unscaled
+	num := new(big.Int).Mul(d.unscaled, pow10(int(scale+o.scale-d.scale)))
+	q, r := new(big.Int).QuoRem(num, o.unscaled, new(big.Int))
+	//四舍五入, 远离0
+	if r.Sign() != 0 {
+		r2 := new(big.Int).Abs(r)
+		r2.Lsh(r2, 1)
+		if r2.Cmp(new(big.Int).Abs(o.unscaled)) >= 0 {
+			if num.Sign()*o.unscaled.Sign() < 0 {
+				q.Sub(q, big.NewInt(1))
+			} else {
+				q.Add(q, big.NewInt(1))
+			}
+		}
+	}
+	return (&Decimal{q, scale}).trim(keep), nil
+}
+
+// Mod 与lua一致的取模, 结果的符号与除数相同
+func (d *Decimal) Mod(o *Decimal) (*Decimal, error) {
+	if o.unscaled.Sign() == 0 {
+		return nil, ErrDivByZero
+	}
+	x, y, scale := align(d, o)
+	r := new(big.Int).Rem(x, y)
+	if r.Sign() != 0 && r.Sign() != y.Sign() {
+		r.Add(r, y)
+	}
+	return &Decimal{r, scale}, nil
+}
+
+// Neg -a
+func (d *Decimal) Neg() *Decimal {
+	return &Decimal{new(big.Int).Neg(d.unscaled), d.scale}
+}
+
+// Cmp a<b时为-1, 相等为0, a>b时为1
+func (d *Decimal) Cmp(o *Decimal) int {
+	x, y, _ := align(d, o)
+	return x.Cmp(y)
+}
+
+// trim 去掉小数部分末尾的0, 至少保留min位小数
+func (d *Decimal) trim(min int32) *Decimal {
+	u, scale := d.unscaled, d.scale
+	if scale <= min || u.Sign() == 0 {
+		if u.Sign() == 0 && scale > min {
+			return &Decimal{u, min}
+		}
+		return d
+	}
+	q, r := new(big.Int), new(big.Int)
+	u = new(big.Int).Set(u)
+	for scale > min {
+		q.QuoRem(u, bigTen, r)
+		if r.Sign() != 0 {
+			break
+		}
+		u, q = q, u
+		scale--
+	}
+	return &Decimal{u, scale}
+}
+
+// Int64 整数且在int64范围内时返回true
+func (d *Decimal) Int64() (int64, bool) {
+	t := d.trim(0)
+	if t.scale != 0 || !t.unscaled.IsInt64() {
+		return 0, false
+	}
+	return t.unscaled.Int64(), true
+}
+
+// Float64 最接近的浮点数
+func (d *Decimal) Float64() float64 {
+	f, _ := strconv.ParseFloat(d.String(), 64)
+	return f
+}
+
+// String 十进制字符串, 保留原有的小数位数
+func (d *Decimal) String() string {
+	s := new(big.Int).Abs(d.unscaled).String()
+	if d.scale > 0 {
+		if n := int(d.scale) + 1 - len(s); n > 0 {
+			s = strings.Repeat("0", n) + s
+		}
+		i := len(s) - int(d.scale)
+		s = s[:i] + "." + s[i:]
+	}
+	if d.unscaled.Sign() < 0 {
+		s = "-" + s
+	}
+	return s
+}
@@ -0,0 +1,118 @@
+package number
+
+import (
+	"math"
+	"strconv"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+var api = map[string]lua.LGFunction{
+	"int64":    apiInt64,
+	"decimal":  apiDecimal,
+	"tonumber": apiToNumber,
+	"type":     apiType,
+}
+
+// Preload 注册number模块, 脚本中通过 require("number") 加载
+func Preload(L *lua.LState) {
+	L.PreloadModule("number", Loader)
+}
+
+// Loader number模块
+func Loader(L *lua.LState) int {
+	t := L.NewTable()
+	L.SetFuncs(t, api)
+	L.Push(t)
+	return 1
+}
+
+// number.int64(v) v为整数、整数字符串、int64或整数值的decimal
+func apiInt64(L *lua.LState) int {
+	lv := L.CheckAny(1)
+	if s, ok := lv.(lua.LString); ok {
+		n, err := strconv.ParseInt(string(s), 10, 64)
+		if err != nil {
+			L.ArgError(1, "无效的int64: "+string(s))
+		}
+		L.Push(NewInt64(n))
+		return 1
+	}
+	o, err := toOperand(lv)
+	if err != nil {
+		L.ArgError(1, err.Error())
+	}
+	if o.d != nil {
+		n, ok := o.d.Int64()
+		if !ok {
+			L.ArgError(1, "超出int64范围或不是整数: "+o.d.String())
+		}
+		o.n = n
+	}
+	L.Push(NewInt64(o.n))
+	return 1
+}
+
+// number.decimal(v) v为数值、十进制字符串、int64或decimal, 字符串保留原有的小数位数
+func apiDecimal(L *lua.LState) int {
+	o, err := toOperand(L.CheckAny(1))
+	if err != nil {
+		L.ArgError(1, err.Error())
+	}
+	L.Push(NewDecimalValue(o.decimal()))
+	return 1
+}
+
+// number.tonumber(v) 转换为lua数值, 可能丢失精度, 无法转换时返回nil
+func apiToNumber(L *lua.LState) int {
+	lv := L.CheckAny(1)
+	ud, ok := lv.(*lua.LUserData)
+	if !ok {
+		if n, ok := lv.(lua.LNumber); ok {
+			L.Push(n)
+			return 1
+		}
+		if s, ok := lv.(lua.LString); ok {
+			if f, err := strconv.ParseFloat(string(s), 64); err == nil {
+				L.Push(lua.LNumber(f))
+				return 1
+			}
+		}
+		L.Push(lua.LNil)
+		return 1
+	}
+	switch v := ud.Value.(type) {
+	case Int64:
+		L.Push(lua.LNumber(v))
+	case *Decimal:
+		f := v.Float64()
+		if math.IsInf(f, 0) {
+			L.Push(lua.LNil)
+			return 1
+		}
+		L.Push(lua.LNumber(f))
+	default:
+		L.Push(lua.LNil)
+	}
+	return 1
+}
+
+// number.type(v) 返回"int64"、"decimal"、"number", 其他类型返回nil
+func apiType(L *lua.LState) int {
+	switch v := L.CheckAny(1).(type) {
+	case lua.LNumber:
+		L.Push(lua.LString("number"))
+		return 1
+	case *lua.LUserData:
+		switch v.Value.(type) {
+		case Int64:
+			L.Push(lua.LString("int64"))
+			return 1
+		case *Decimal:
+			L.Push(lua.LString("decimal"))
+			return 1
+		}
+	}
+	L.Push(lua.LNil)
+	return 1
+}
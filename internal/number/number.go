@@ -0,0 +1,356 @@
+// Package number 在lua中无损地表示64位整数和十进制定点数.
+//
+// lua的数值都是float64, 超过2^53的整数和小数位较多的定点数会丢失精度,
+// 这类值以userdata返回, 支持 + - * / % 、比较和tostring:
+//
+//	local number = require("number")
+//	local id = number.int64("9007199254740993")
+//	local price = number.decimal("0.10") * 3
+//	print(id + 1, price, number.type(price))
+//
+// 与lua数值之间只能做算术运算. gopher-lua中userdata与lua数值比较时 == 总是为false,
+// < 等会报错, 比较时需先用number.int64/decimal转换另一侧, 或用number.tonumber
+// 转换为lua数值(可能丢失精度):
+//
+//	if row.id == number.int64(5) then ... end
+//
+// sql查询结果、json、mongodb中的值可以精确表示时为lua数值, 只有超出精度时才为userdata,
+// 因此 count(*) 等结果可以直接与lua数值比较
+package number
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Int64 userdata中的64位整数
+type Int64 int64
+
+// maxExact float64可以精确表示的最大整数
+const maxExact = 1 << 53
+
+// 元表不属于任何虚拟机, 创建的userdata可以放在虚拟机间共享的缓存中.
+// 元表设置了__metatable, 脚本中getmetatable只能得到类型名, 无法修改共享的元方法
+var (
+	env         = newTable()
+	int64Meta   *lua.LTable
+	decimalMeta *lua.LTable
+)
+
+// newTable 不属于任何虚拟机的空table
+func newTable() *lua.LTable {
+	return &lua.LTable{Metatable: lua.LNil}
+}
+
+func init() {
+	int64Meta = newMeta("int64")
+	decimalMeta = newMeta("decimal")
+}
+
+func newFunc(fn lua.LGFunction) *lua.LFunction {
+	return &lua.LFunction{IsG: true, Env: env, GFunction: fn}
+}
+
+// 两种类型使用相同的元方法, 比较运算要求两侧的元方法相同
+var metaMethods = map[string]*lua.LFunction{
+	"__add":      newFunc(func(L *lua.LState) int { return arith(L, opAdd) }),
+	"__sub":      newFunc(func(L *lua.LState) int { return arith(L, opSub) }),
+	"__mul":      newFunc(func(L *lua.LState) int { return arith(L, opMul) }),
+	"__div":      newFunc(func(L *lua.LState) int { return arith(L, opDiv) }),
+	"__mod":      newFunc(func(L *lua.LState) int { return arith(L, opMod) }),
+	"__unm":      newFunc(unm),
+	"__eq":       newFunc(func(L *lua.LState) int { return compare(L, func(c int) bool { return c == 0 }) }),
+	"__lt":       newFunc(func(L *lua.LState) int { return compare(L, func(c int) bool { return c < 0 }) }),
+	"__le":       newFunc(func(L *lua.LState) int { return compare(L, func(c int) bool { return c <= 0 }) }),
+	"__tostring": newFunc(tostring),
+	"__concat":   newFunc(concat),
+}
+
+func newMeta(name string) *lua.LTable {
+	mt := newTable()
+	for k, fn := range metaMethods {
+		mt.RawSetString(k, fn)
+	}
+	mt.RawSetString("__name", lua.LString(name))
+	mt.RawSetString("__metatable", lua.LString(name))
+	return mt
+}
+
+// NewInt64 创建int64 userdata
+func NewInt64(n int64) *lua.LUserData {
+	return &lua.LUserData{Value: Int64(n), Env: env, Metatable: int64Meta}
+}
+
+// NewDecimalValue 创建decimal userdata
+func NewDecimalValue(d *Decimal) *lua.LUserData {
+	return &lua.LUserData{Value: d, Env: env, Metatable: decimalMeta}
+}
+
+// FromInt64 可以精确表示时为lua数值, 否则为int64 userdata
+func FromInt64(n int64) lua.LValue {
+	if n >= -maxExact && n <= maxExact {
+		return lua.LNumber(n)
+	}
+	return NewInt64(n)
+}
+
+// FromUint64 超出int64范围时为decimal userdata
+func FromUint64(n uint64) lua.LValue {
+	if n <= math.MaxInt64 {
+		return FromInt64(int64(n))
+	}
+	return NewDecimalValue(&Decimal{unscaled: new(big.Int).SetUint64(n)})
+}
+
+// FromString 解析十进制数, 可以精确表示时为lua数值,
+// 否则整数为int64 userdata, 超出int64范围或有小数的为decimal userdata
+func FromString(s string) (lua.LValue, error) {
+	d, err := ParseDecimal(s)
+	if err != nil {
+		return nil, err
+	}
+	return FromDecimal(d), nil
+}
+
+// FromDecimal 同FromString
+func FromDecimal(d *Decimal) lua.LValue {
+	if n, ok := d.Int64(); ok {
+		return FromInt64(n)
+	}
+	f := d.Float64()
+	if !math.IsInf(f, 0) {
+		if back, err := decimalFromFloat(f); err == nil && back.Cmp(d) == 0 {
+			return lua.LNumber(f)
+		}
+	}
+	return NewDecimalValue(d)
+}
+
+// ToGo 将int64、decimal userdata转换为Go值, 分别为int64和json.Number,
+// 可以作为sql参数或json编码. 不是这两种类型时返回false
+func ToGo(lv lua.LValue) (interface{}, bool) {
+	ud, ok := lv.(*lua.LUserData)
+	if !ok {
+		return nil, false
+	}
+	switch v := ud.Value.(type) {
+	case Int64:
+		return int64(v), true
+	case *Decimal:
+		return json.Number(v.String()), true
+	}
+	return nil, false
+}
+
+// String int64、decimal userdata的十进制字符串
+func String(lv lua.LValue) (string, bool) {
+	ud, ok := lv.(*lua.LUserData)
+	if !ok {
+		return "", false
+	}
+	switch v := ud.Value.(type) {
+	case Int64:
+		return strconv.FormatInt(int64(v), 10), true
+	case *Decimal:
+		return v.String(), true
+	}
+	return "", false
+}
+
+// operand 参与运算的值, d为nil时为整数n
+type operand struct {
+	n int64
+	d *Decimal
+}
+
+func (o operand) decimal() *Decimal {
+	if o.d != nil {
+		return o.d
+	}
+	return NewDecimal(o.n)
+}
+
+// toOperand lua数值中的整数视为int64, 字符串按十进制解析
+func toOperand(lv lua.LValue) (operand, error) {
+	switch v := lv.(type) {
+	case lua.LNumber:
+		f := float64(v)
+		if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+			return operand{n: int64(f)}, nil
+		}
+		d, err := decimalFromFloat(f)
+		return operand{d: d}, err
+	case lua.LString:
+		d, err := ParseDecimal(string(v))
+		if err != nil {
+			return operand{}, err
+		}
+		if n, ok := d.Int64(); ok && d.scale == 0 {
+			return operand{n: n}, nil
+		}
+		return operand{d: d}, nil
+	case *lua.LUserData:
+		switch x := v.Value.(type) {
+		case Int64:
+			return operand{n: int64(x)}, nil
+		case *Decimal:
+			return operand{d: x}, nil
+		}
+	}
+	return operand{}, fmt.Errorf("不能与%s进行运算", lv.Type().String())
+}
+
+type op int
+
+const (
+	opAdd op = iota
+	opSub
+	opMul
+	opDiv
+	opMod
+)
+
+func arith(L *lua.LState, o op) int {
+	a, err := toOperand(L.Get(1))
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+	b, err := toOperand(L.Get(2))
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+	if a.d == nil && b.d == nil {
+		if n, ok, err := intArith(o, a.n, b.n); err != nil {
+			L.RaiseError("%v", err)
+		} else if ok {
+			L.Push(NewInt64(n))
+			return 1
+		}
+	}
+	//有小数、溢出或除不尽时按decimal计算
+	x, y := a.decimal(), b.decimal()
+	var r *Decimal
+	switch o {
+	case opAdd:
+		r = x.Add(y)
+	case opSub:
+		r = x.Sub(y)
+	case opMul:
+		r = x.Mul(y)
+	case opDiv:
+		r, err = x.Div(y)
+	case opMod:
+		r, err = x.Mod(y)
+	}
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+	L.Push(NewDecimalValue(r))
+	return 1
+}
+
+// intArith 溢出或除不尽时返回false
+func intArith(o op, a, b int64) (int64, bool, error) {
+	switch o {
+	case opAdd:
+		r := a + b
+		return r, (r > a) == (b > 0), nil
+	case opSub:
+		r := a - b
+		return r, (r < a) == (b > 0), nil
+	case opMul:
+		if a == 0 || b == 0 {
+			return 0, true, nil
+		}
+		r := a * b
+		return r, r/b == a && !(a == -1 && b == math.MinInt64) && !(b == -1 && a == math.MinInt64), nil
+	case opDiv:
+		if b == 0 {
+			return 0, false, ErrDivByZero
+		}
+		if b == -1 && a == math.MinInt64 || a%b != 0 {
+			return 0, false, nil
+		}
+		return a / b, true, nil
+	case opMod:
+		if b == 0 {
+			return 0, false, ErrDivByZero
+		}
+		if b == -1 {
+			return 0, true, nil
+		}
+		r := a % b
+		if r != 0 && (r < 0) != (b < 0) {
+			r += b
+		}
+		return r, true, nil
+	}
+	return 0, false, nil
+}
+
+func unm(L *lua.LState) int {
+	a, err := toOperand(L.Get(1))
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+	if a.d == nil && a.n != math.MinInt64 {
+		L.Push(NewInt64(-a.n))
+		return 1
+	}
+	L.Push(NewDecimalValue(a.decimal().Neg()))
+	return 1
+}
+
+func compare(L *lua.LState, ok func(int) bool) int {
+	a, err := toOperand(L.Get(1))
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+	b, err := toOperand(L.Get(2))
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+	var c int
+	switch {
+	case a.d == nil && b.d == nil && a.n < b.n:
+		c = -1
+	case a.d == nil && b.d == nil && a.n > b.n:
+		c = 1
+	case a.d == nil && b.d == nil:
+		c = 0
+	default:
+		c = a.decimal().Cmp(b.decimal())
+	}
+	L.Push(lua.LBool(ok(c)))
+	return 1
+}
+
+func tostring(L *lua.LState) int {
+	s, _ := String(L.Get(1))
+	L.Push(lua.LString(s))
+	return 1
+}
+
+func concat(L *lua.LState) int {
+	var s [2]string
+	for i := range s {
+		lv := L.Get(i + 1)
+		switch lv.Type() {
+		case lua.LTString, lua.LTNumber:
+			s[i] = lv.String()
+		default:
+			str, ok := String(lv)
+			if !ok {
+				L.RaiseError("attempt to concatenate a %s value", lv.Type().String())
+			}
+			s[i] = str
+		}
+	}
+	L.Push(lua.LString(s[0] + s[1]))
+	return 1
+}
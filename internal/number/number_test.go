@@ -0,0 +1,123 @@
+package number
+
+import (
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestDecimal(t *testing.T) {
+	cases := []struct {
+		op   func(a, b *Decimal) (*Decimal, error)
+		a, b string
+		want string
+	}{
+		{func(a, b *Decimal) (*Decimal, error) { return a.Add(b), nil }, "0.1", "0.2", "0.3"},
+		{func(a, b *Decimal) (*Decimal, error) { return a.Sub(b), nil }, "1", "1.50", "-0.50"},
+		{func(a, b *Decimal) (*Decimal, error) { return a.Mul(b), nil }, "-0.5", "0.25", "-0.125"},
+		{(*Decimal).Div, "10.00", "4", "2.50"},
+		{(*Decimal).Div, "1", "3", "0.3333333333333333"},
+		{(*Decimal).Div, "-2", "3", "-0.6666666666666667"},
+		{(*Decimal).Mod, "-5.5", "2", "0.5"},
+		{func(a, b *Decimal) (*Decimal, error) { return a.Add(b), nil }, "1e3", "1.5E-2", "1000.015"},
+	}
+	for _, c := range cases {
+		a, err := ParseDecimal(c.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ParseDecimal(c.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := c.op(a, b)
+		if err != nil || r.String() != c.want {
+			t.Errorf("%s, %s 得到 %v %v, 期望 %s", c.a, c.b, r, err, c.want)
+		}
+	}
+	//连续相乘时小数位数不超过MaxExponent
+	d, _ := ParseDecimal("0.15")
+	r := d
+	for i := 0; i < 2000; i++ {
+		r = r.Mul(d)
+	}
+	if r.scale != MaxExponent {
+		t.Errorf("连乘后小数位数为%d", r.scale)
+	}
+	if r, _ = ParseDecimal("-0.5"); r.Mul(r).Mul(NewDecimal(1)).round(0).String() != "0" || r.round(0).String() != "-1" {
+		t.Errorf("四舍五入不符 %v", r.round(0))
+	}
+	for _, s := range []string{"", "-", ".", "1.2.3", "abc", "1e", "1e999999999", "1e-1001", "0." + strings.Repeat("1", 1001)} {
+		if _, err := ParseDecimal(s); err == nil {
+			t.Errorf("%q 未返回错误", s)
+		}
+	}
+}
+
+func TestFromString(t *testing.T) {
+	cases := []struct {
+		s    string
+		want string //lua中的类型
+	}{
+		{"9007199254740992", "number"},
+		{"9007199254740993", "int64"},
+		{"-9223372036854775808", "int64"},
+		{"9223372036854775808", "decimal"},
+		{"12.50", "number"},
+		{"0.1", "number"},
+		{"0.10000000000000000001", "decimal"},
+	}
+	for _, c := range cases {
+		lv, err := FromString(c.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		typ := "number"
+		if ud, ok := lv.(*lua.LUserData); ok {
+			typ = ud.Metatable.(*lua.LTable).RawGetString("__name").String()
+		}
+		if typ != c.want {
+			t.Errorf("%s 得到 %s, 期望 %s", c.s, typ, c.want)
+		}
+		if s, ok := String(lv); ok && s != c.s {
+			t.Errorf("%s 转换后为 %s", c.s, s)
+		}
+	}
+}
+
+func TestLuaNumber(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	Preload(L)
+	L.SetGlobal("big", NewInt64(9007199254740993))
+	script := `
+		local number = require("number")
+		local a = number.int64("9223372036854775807")
+		assert(tostring(a + 0) == "9223372036854775807")
+		assert(number.type(a + 1) == "decimal" and tostring(a + 1) == "9223372036854775808", "溢出未转换为decimal")
+		assert(number.type(big + 2) == "int64" and tostring(big + 2) == "9007199254740995")
+		assert(big == number.int64("9007199254740993"))
+		assert(big < number.decimal("9007199254740993.5"))
+		assert(big >= number.int64(1))
+		assert(number.int64(7) / 2 == number.decimal("3.5"))
+		assert(number.type(number.int64(8) / 2) == "int64")
+		assert(number.int64(-7) % 3 == number.int64(2))
+		assert(tostring(-number.decimal("1.10")) == "-1.10")
+		assert(tostring(number.decimal("0.1") + 0.2) == "0.3")
+		assert("id:" .. big == "id:9007199254740993")
+		assert(number.tonumber(number.decimal("2.5")) == 2.5)
+		assert(number.type(1) == "number" and number.type("1") == nil)
+		assert(big ~= 9007199254740993 and number.tonumber(big) == 9007199254740992)
+		assert(getmetatable(big) == "int64", "元表未锁定")
+		local ok = pcall(function() return big < 1 end)
+		assert(not ok, "与lua数值比较未报错")
+		local ok, err = pcall(function() return number.int64(1) / 0 end)
+		assert(not ok and string.find(err, "除数为0"))
+		ok = pcall(number.int64, 1.5)
+		assert(not ok, "非整数转换为int64未报错")
+	`
+	if err := L.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+}
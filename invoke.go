@@ -0,0 +1,114 @@
+package luavm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"luavm/internal/number"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/yuin/gluamapper"
+	lua "github.com/yuin/gopher-lua"
+	luar "layeh.com/gopher-luar"
+)
+
+// resultOption 返回值映射使用与luar相同的 `luar:"name"` 标签,
+// 未设置标签时字段名忽略大小写匹配
+var resultOption = gluamapper.Option{
+	NameFunc: gluamapper.Id,
+	TagName:  "luar",
+}
+
+// ScriptError 脚本返回了表示失败的errNo, 见Result.Success
+type ScriptError struct {
+	ErrNo  string
+	ErrMsg string
+}
+
+func (e *ScriptError) Error() string {
+	return fmt.Sprintf("脚本返回错误[%s] %s", e.ErrNo, e.ErrMsg)
+}
+
+// MappingError 脚本返回值无法转换为Go类型, Fields为每个字段的转换错误
+type MappingError struct {
+	Busi     string
+	Trancode string
+	Fields   []string
+}
+
+func (e *MappingError) Error() string {
+	return fmt.Sprintf("交易[%s/%s]返回值转换失败: %s", e.Busi, e.Trancode, strings.Join(e.Fields, "; "))
+}
+
+// Invoke 从pool中取出虚拟机, 将in通过luar设置为easy.request后运行busi/trancode,
+// 并将返回的数据(第三个返回值或easy.response)映射为Out.
+// 脚本返回的errNo不为空或ErrNoSuccess时返回*ScriptError, 此时Out仍为已映射的数据
+//
+//	type Req struct {
+//		Name string `luar:"name"`
+//	}
+//	type Resp struct {
+//		Greeting string `luar:"greeting"`
+//	}
+//	resp, err := luavm.Invoke[Req, Resp](ctx, pool, "busi", "hello", Req{Name: "easy"})
+func Invoke[In, Out any](ctx context.Context, pool *LuaPool, busi, trancode string, in In) (out Out, err error) {
+	vm, err := pool.GetContext(ctx)
+	if err != nil {
+		return
+	}
+	defer pool.Put(vm)
+
+	vm.SetEasyAttr("request", luar.New(vm.l, in))
+	res, err := vm.Execute(ctx, busi, trancode)
+	if err != nil {
+		return
+	}
+	if err = mapResult(res.Raw, &out); err != nil {
+		var me *mapstructure.Error
+		if errors.As(err, &me) {
+			err = &MappingError{Busi: busi, Trancode: trancode, Fields: me.Errors}
+		} else {
+			err = &MappingError{Busi: busi, Trancode: trancode, Fields: []string{err.Error()}}
+		}
+		return
+	}
+	if !res.Success() {
+		err = &ScriptError{ErrNo: res.ErrNo, ErrMsg: res.ErrMsg}
+	}
+	return
+}
+
+// numberHook int64、decimal映射为int64和json.Number, 可以赋值给整数、浮点数和字符串字段
+func numberHook(from, to reflect.Type, data interface{}) (interface{}, error) {
+	ud, ok := data.(*lua.LUserData)
+	if !ok {
+		return data, nil
+	}
+	if ud == sqlNull {
+		return nil, nil
+	}
+	if n, ok := number.ToGo(ud); ok {
+		return n, nil
+	}
+	return data, nil
+}
+
+// mapResult 将lua返回值映射到dst, nil不做处理
+func mapResult(lv lua.LValue, dst interface{}) error {
+	if lv == lua.LNil {
+		return nil
+	}
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		WeaklyTypedInput: true,
+		Result:           dst,
+		TagName:          resultOption.TagName,
+		DecodeHook:       numberHook,
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(gluamapper.ToGoValue(lv, resultOption))
+}
@@ -0,0 +1,62 @@
+package luavm
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestInvoke(t *testing.T) {
+	root := t.TempDir()
+	writeScripts(t, root, map[string]string{
+		"busi/hello/main.lua": `
+		local req = easy.request
+		return "", "", {greeting = "hello " .. req.name, count = req.count + 1, tags = {"a", "b"}}
+	`,
+		"busi/ok/main.lua":   `return "0000", "成功", {greeting = "ok"}`,
+		"busi/fail/main.lua": `return "0001", "失败", {greeting = "no"}`,
+		"busi/bad/main.lua":  `return "", "", {count = "abc"}`,
+	})
+	busi := "busi"
+
+	type req struct {
+		Name  string `luar:"name"`
+		Count int
+	}
+	type resp struct {
+		Greeting string `luar:"greeting"`
+		Count    int
+		Tags     []string `luar:"tags"`
+	}
+	pool := NewLuaPool()
+	pool.SetFS(os.DirFS(root))
+	ctx := context.Background()
+
+	out, err := Invoke[req, resp](ctx, pool, busi, "hello", req{Name: "easy", Count: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Greeting != "hello easy" || out.Count != 2 || len(out.Tags) != 2 {
+		t.Fatalf("返回结果不符 %+v", out)
+	}
+
+	//"0000"与空errNo同样视为成功
+	out, err = Invoke[req, resp](ctx, pool, busi, "ok", req{})
+	if err != nil || out.Greeting != "ok" {
+		t.Fatalf("errNo为0000时返回不符 %v %+v", err, out)
+	}
+
+	out, err = Invoke[req, resp](ctx, pool, busi, "fail", req{})
+	var se *ScriptError
+	if !errors.As(err, &se) || se.ErrNo != "0001" || out.Greeting != "no" {
+		t.Fatalf("脚本错误返回不符 %v %+v", err, out)
+	}
+
+	_, err = Invoke[req, resp](ctx, pool, busi, "bad", req{})
+	var me *MappingError
+	if !errors.As(err, &me) || len(me.Fields) != 1 || !strings.Contains(me.Fields[0], "Count") {
+		t.Fatalf("字段转换错误不符 %v", err)
+	}
+}
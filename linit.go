@@ -1,6 +1,10 @@
 package luavm
 
 import (
+	"fmt"
+	"os"
+	"time"
+
 	"github.com/BurntSushi/toml"
 	lua "github.com/yuin/gopher-lua"
 )
@@ -46,13 +50,135 @@ var luaLibs = []luaLib{
 	luaLib{coroutineLibName, lua.OpenCoroutine},
 }
 
-//OpenLibs 加载lua基本库
+//OpenLibs 加载lua基本库, 配置了[Sandbox]时只加载允许的库和函数
 func (l *LuaVM) OpenLibs() {
+	var sb *sandboxConfig
+	if l.conf != nil {
+		sb = l.conf.Sandbox
+	}
 	for _, lib := range luaLibs {
+		if !sb.allowLib(lib.libName) {
+			continue
+		}
+		var before map[string]bool
+		if lib.libName == baseLibName {
+			before = l.globalNames()
+		}
 		l.l.Push(l.l.NewFunction(lib.libFunc))
 		l.l.Push(lua.LString(lib.libName))
 		l.l.Call(1, 0)
+		if funcs, ok := sb.funcs(lib.libName); ok {
+			l.filterLib(lib.libName, funcs, before)
+		}
+	}
+}
+
+//globalNames 当前所有全局变量名
+func (l *LuaVM) globalNames() map[string]bool {
+	names := make(map[string]bool, 64)
+	l.l.G.Global.ForEach(func(k, v lua.LValue) {
+		if s, ok := k.(lua.LString); ok {
+			names[string(s)] = true
+		}
+	})
+	return names
+}
+
+//filterLib 删除库中不在允许列表中的函数,
+//基本库的函数直接注册在全局表中, 只处理before之后新增的全局函数
+func (l *LuaVM) filterLib(libName string, funcs []string, before map[string]bool) {
+	allow := make(map[string]bool, len(funcs))
+	for _, f := range funcs {
+		allow[f] = true
+	}
+	tb := l.l.G.Global
+	if libName == baseLibName {
+		//插件通过require加载, 始终保留
+		allow["require"] = true
+	} else {
+		var ok bool
+		if tb, ok = l.l.GetGlobal(libName).(*lua.LTable); !ok {
+			return
+		}
+	}
+	var removed []string
+	tb.ForEach(func(k, v lua.LValue) {
+		name, ok := k.(lua.LString)
+		if !ok || v.Type() != lua.LTFunction || allow[string(name)] || before[string(name)] {
+			return
+		}
+		removed = append(removed, string(name))
+	})
+	for _, name := range removed {
+		tb.RawSetString(name, lua.LNil)
+	}
+}
+
+//sandboxConfig 沙箱配置, 未配置时加载全部基本库
+//
+//	[Sandbox]
+//	Libs = ["base", "table", "string", "math", "os"]
+//	[Sandbox.Funcs]
+//	os = ["time", "date", "clock"]
+type sandboxConfig struct {
+	//允许加载的库, 基本库为 "base", package库始终加载
+	Libs []string
+	//只开放部分函数的库, 库名 -> 允许的函数
+	Funcs map[string][]string
+}
+
+//sandboxName 配置中使用的库名
+func sandboxName(libName string) string {
+	if libName == baseLibName {
+		return "base"
+	}
+	return libName
+}
+
+func (s *sandboxConfig) allowLib(libName string) bool {
+	if s == nil || libName == loadLibName {
+		return true
+	}
+	name := sandboxName(libName)
+	for _, lib := range s.Libs {
+		if lib == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *sandboxConfig) funcs(libName string) ([]string, bool) {
+	if s == nil {
+		return nil, false
+	}
+	funcs, ok := s.Funcs[sandboxName(libName)]
+	return funcs, ok
+}
+
+//check 检查配置中的库名
+func (s *sandboxConfig) check() error {
+	if s == nil {
+		return nil
+	}
+	known := make(map[string]bool, len(luaLibs))
+	for _, lib := range luaLibs {
+		known[sandboxName(lib.libName)] = true
+	}
+	for _, lib := range s.Libs {
+		if !known[lib] {
+			return fmt.Errorf("沙箱配置了未知的库[%s]", lib)
+		}
+	}
+	for lib := range s.Funcs {
+		if !known[lib] {
+			return fmt.Errorf("沙箱配置了未知的库[%s]", lib)
+		}
+		if !s.allowLib(lib) {
+			return fmt.Errorf("沙箱库[%s]配置了函数但未在Libs中允许", lib)
+		}
 	}
+	return nil
 }
 
 type sqlConfig struct {
@@ -63,40 +189,70 @@ type sqlConfig struct {
 	Passwd   string
 	DataBase string
 	Params   string
+	//连接池配置, 0为使用database/sql的默认值
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+	//启动时检查数据库是否可以连接
+	Ping bool
+	//查询结果中NULL的转换: "null"(默认)为模块的null值, "omit"为省略该字段
+	Null string
+	//日期时间的转换: "iso"(默认)为ISO 8601字符串, "epoch"为unix时间戳(秒)
+	Time string
+}
+
+//poolConfig 虚拟机池容量及重建配置, 0为不限制
+type poolConfig struct {
+	MaxActive     int
+	MaxIdle       int
+	MinIdle       int
+	MaxExecutions int
+	MaxStackSize  int
+	MaxGlobals    int
+	//关闭脚本编译缓存,用于开发环境
+	DisableScriptCache bool
+	//每次执行的超时时间,如 "5s"
+	ExecTimeout time.Duration
 }
 
 type luaConfig struct {
-	Redis struct {
-		Addr     string
-		Passwd   string
-		DataBase int
-	}
-	Mongodb struct {
-		Addr   string
-		User   string
-		Passwd string
-	}
-	SQLS []*sqlConfig `toml:"SQL"`
+	Pool    poolConfig
+	Sandbox *sandboxConfig
+	//配置文件中的所有段, 插件从中读取各自的配置
+	sections *PluginConfig
+	//解析 ${ref} 引用, 环境变量总是最后查找
+	providers []SecretProvider
 }
 
 func (l *luaConfig) LoadFromFile(filename string) (err error) {
-	if l == nil {
-		l = new(luaConfig)
-	}
-	if _, err = toml.DecodeFile(filename, l); err != nil {
+	data, err := os.ReadFile(filename)
+	if err != nil {
 		return
 	}
-	return nil
+	return l.LoadFromConf(string(data))
 }
 
 func (l *luaConfig) LoadFromConf(conf string) (err error) {
 	if l == nil {
 		l = new(luaConfig)
 	}
-	if _, err = toml.Decode(conf, l); err != nil {
+	if err = l.checkRefs(conf); err != nil {
 		return
 	}
-	return nil
+	var sections map[string]toml.Primitive
+	md, err := toml.Decode(conf, &sections)
+	if err != nil {
+		return
+	}
+	l.sections = &PluginConfig{md: md, sections: sections, conf: l}
+	if _, err = l.sections.Decode("Pool", &l.Pool); err != nil {
+		return
+	}
+	if _, err = l.sections.Decode("Sandbox", &l.Sandbox); err != nil {
+		return
+	}
+	return l.Sandbox.check()
 }
 
 var bigintLib = `
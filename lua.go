@@ -2,11 +2,17 @@ package luavm
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
+	"path"
+	"reflect"
 	"sync"
+	"time"
 
 	json "luavm/internal/gopher-json"
+	"luavm/internal/number"
 
 	mapCtx "github.com/yireyun/go_context"
 	"github.com/yuin/gluamapper"
@@ -18,6 +24,13 @@ const (
 	loggerInterface = "logger-interface"
 )
 
+var (
+	// ErrPoolClosed 虚拟机池已经关闭
+	ErrPoolClosed = errors.New("虚拟机池已关闭")
+	// ErrExecTimeout 脚本执行超时或被取消, 返回的错误同时包含ctx的错误
+	ErrExecTimeout = errors.New("脚本执行超时")
+)
+
 // LuaVM lua虚拟机,每一个lua脚本维护一个lua状态
 type LuaVM struct {
 	lock     sync.Mutex
@@ -25,15 +38,31 @@ type LuaVM struct {
 	conf     *luaConfig
 	easy     *lua.LTable //easy 全局对象
 	easyInit bool
-	trans    []*sqlState //mysql事务状态
-}
+	trans    []*sqlState     //mysql事务状态
+	execs    int             //已执行脚本的次数
+	snap     *globalSnapshot //初始化完成后的全局环境
+	stats    *poolStats      //所属虚拟机池的统计数据
+	scripts  *scriptCache    //编译后的脚本缓存,为nil时每次重新编译
+	gen      uint64          //创建时的脚本重新加载次数
+	logger   Logger          //脚本中使用的日志接口
+	timeout  time.Duration   //未指定ctx时每次执行的超时时间,0为不限制
+	fsys     fs.FS           //脚本根目录
+	busi     string          //DoFile执行中的业务目录,require只能加载此目录下的文件
+}
+
+// registryInitSize 寄存器栈的初始容量, 按需增长到lua.RegistrySize,
+// 增长后不再收缩, 虚拟机池据此判断执行期间用到的最大深度
+const registryInitSize = 1024
 
 // NewLuaVM ...
 func NewLuaVM(conf *luaConfig) *LuaVM {
 	l := new(LuaVM)
 	l.conf = conf
+	l.fsys = osFS{}
 	l.l = lua.NewState(lua.Options{
-		SkipOpenLibs: true,
+		SkipOpenLibs:    true,
+		RegistrySize:    registryInitSize,
+		RegistryMaxSize: lua.RegistrySize,
 	})
 	return l
 }
@@ -56,8 +85,8 @@ func (l *LuaVM) SetContext(ctx context.Context) {
 	l.l.SetContext(ctx)
 }
 
-// LoadLibs 加载常用的库
-func (l *LuaVM) LoadLibs(my, ms, sl, rl, gl lua.LGFunction) {
+// LoadLibs 加载常用的库和插件
+func (l *LuaVM) LoadLibs(plugins ...Plugin) {
 	//加载基本库
 	l.OpenLibs()
 	//加载bigint库
@@ -66,14 +95,12 @@ func (l *LuaVM) LoadLibs(my, ms, sl, rl, gl lua.LGFunction) {
 	}
 	//加载json插件
 	l.PreLoadModule("json", json.Loader)
-	//加载sql插件
-	l.PreLoadModule("mysql", my)
-	l.PreLoadModule("mssql", ms)
-	l.PreLoadModule("sqlite", sl)
-	//加载redis插件
-	l.PreLoadModule("redis", rl)
-	//加载mongodb插件
-	l.PreLoadModule("mongodb", gl)
+	//加载int64、decimal
+	l.PreLoadModule("number", number.Loader)
+	//加载sql、redis、mongodb及自定义插件
+	for _, p := range plugins {
+		l.PreLoadModule(p.Name(), p.Loader)
+	}
 }
 
 // PreLoadModule 加载自定义库
@@ -83,18 +110,26 @@ func (l *LuaVM) PreLoadModule(name string, loader lua.LGFunction) {
 
 // DoString 执行一个lua字符串
 func (l *LuaVM) DoString(str string) (errNo, errMsg string, err error) {
+	return l.DoStringContext(context.Background(), str)
+}
+
+// DoStringContext 同DoString, ctx结束时中断脚本执行并返回ErrExecTimeout,
+// ctx同时用于脚本中的sql/redis/mongodb调用
+func (l *LuaVM) DoStringContext(ctx context.Context, str string) (errNo, errMsg string, err error) {
+	res, err := l.ExecuteString(ctx, str)
+	if res != nil {
+		errNo, errMsg = res.ErrNo, res.ErrMsg
+	}
+	return
+}
+
+func (l *LuaVM) doString(str string) (res *Result, err error) {
+	start := time.Now()
+	var errNo string
+	defer func() { l.observe("", "", start, errNo, err) }()
 	//初始化easy全局变量
 	l.initEasy()
-
-	defer func() {
-		//如果存在事务状态则全部回滚
-		for _, tran := range l.trans {
-			if tran.tx != nil {
-				tran.tx.Rollback()
-			}
-		}
-		l.trans = nil
-	}()
+	defer l.rollback()
 
 	l.lock.Lock()
 	defer l.lock.Unlock()
@@ -104,24 +139,16 @@ func (l *LuaVM) DoString(str string) (errNo, errMsg string, err error) {
 		return
 	}
 
-	if err = l.l.DoString(str); err != nil {
+	fn, err := l.l.LoadString(str)
+	if err != nil {
 		return
 	}
-
-	//获取lua返回值
-	num := l.l.GetTop()
-	switch num {
-	//没有返回值默认为成功
-	case 0:
-		errNo, errMsg = "", ""
-	case 1:
-		errNo = l.l.ToString(1)
-		errMsg = ""
-	case 2:
-		errNo = l.l.ToString(1)
-		errMsg = l.l.ToString(2)
-	default:
+	//返回值保留在栈上, 兼容直接从栈上读取返回值的用法
+	base := l.l.GetTop()
+	if res, err = l.call(fn, base); err != nil {
+		return
 	}
+	errNo = res.ErrNo
 	return
 }
 
@@ -133,34 +160,144 @@ func (l *LuaVM) GetEasyAttr(name string) lua.LValue {
 // DoFile 根据busitype和trancode加载一个lua文件并运行,
 // 这里将设置luarequire目录, 只允许lua中加载同一业务下的代码
 func (l *LuaVM) DoFile(busi, trancode string) (err error) {
+	return l.DoFileContext(context.Background(), busi, trancode)
+}
+
+// DoFileContext 同DoFile, ctx结束时中断脚本执行并返回ErrExecTimeout,
+// ctx同时用于脚本中的sql/redis/mongodb调用
+func (l *LuaVM) DoFileContext(ctx context.Context, busi, trancode string) error {
+	_, err := l.Execute(ctx, busi, trancode)
+	return err
+}
+
+func (l *LuaVM) doFile(busi, trancode string) (res *Result, err error) {
+	start := time.Now()
+	var errNo string
+	defer func() { l.observe(busi, trancode, start, errNo, err) }()
 	l.initEasy()
+	defer l.rollback()
 	l.lock.Lock()
 	defer l.lock.Unlock()
 
-	fp := fmt.Sprintf("./%s/%s/main.lua", busi, trancode)
-	dir := fmt.Sprintf("./%s/?.lua", busi)
+	fp := path.Join(busi, trancode, "main.lua")
+	dir := path.Join(busi, "?.lua")
 	//设置require目录
 	l.l.SetField(l.l.GetField(l.l.Get(lua.EnvironIndex), "package"), "path", lua.LString(dir))
+	l.busi = busi
+	defer func() { l.busi = "" }()
 
-	if err = l.l.DoFile(fp); err != nil {
+	fn, err := l.loadFile(fp)
+	if err != nil {
+		return
+	}
+	//同一虚拟机多次执行时栈上可能留有上次的返回值
+	base := l.l.GetTop()
+	defer l.l.SetTop(base)
+	if res, err = l.call(fn, base); err != nil {
 		return
 	}
+	errNo = res.ErrNo
+	return
+}
 
-	//获取lua返回值
-	num := l.l.GetTop()
-	var arg1, arg2 string
-	switch num {
-	//没有返回值默认为成功
-	case 0:
-	case 1:
-		arg1 = l.l.CheckString(1)
-	case 2:
-		arg1 = l.l.CheckString(1)
-		arg2 = l.l.CheckString(2)
-	default:
-	}
-	_, _ = arg1, arg2
-	return nil
+// call 执行fn并读取栈上base之后的返回值
+func (l *LuaVM) call(fn *lua.LFunction, base int) (*Result, error) {
+	l.l.Push(fn)
+	if err := l.l.PCall(0, lua.MultRet, nil); err != nil {
+		return nil, err
+	}
+	l.record()
+	return l.result(base), nil
+}
+
+// runContext 在ctx下执行fn, 执行期间脚本的context替换为ctx,
+// 未设置截止时间时使用虚拟机池配置的超时时间
+func (l *LuaVM) runContext(ctx context.Context, fn func() error) error {
+	if _, ok := ctx.Deadline(); !ok && l.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.timeout)
+		defer cancel()
+	}
+	//执行结束后取消,未提交的事务将由database/sql回滚
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	base := l.l.Context()
+	l.l.SetContext(l.withValues(cctx))
+	defer func() {
+		if base == nil {
+			l.l.RemoveContext()
+		} else {
+			l.l.SetContext(base)
+		}
+	}()
+
+	err := fn()
+	if err != nil && ctx.Err() != nil {
+		err = fmt.Errorf("%w: %w", ErrExecTimeout, ctx.Err())
+	}
+	return err
+}
+
+// withValues 在ctx中加入插件需要的事务注册函数和日志接口
+func (l *LuaVM) withValues(ctx context.Context) context.Context {
+	ctx = mapCtx.WithValue(ctx, tranfunc("addTran"), l.addTran)
+	if l.logger != nil {
+		ctx = mapCtx.WithValue(ctx, loggerInterface, l.logger)
+	}
+	return ctx
+}
+
+// rollback 回滚脚本中未提交的事务
+func (l *LuaVM) rollback() {
+	for _, tran := range l.trans {
+		if tran.tx != nil {
+			tran.tx.Rollback()
+		}
+	}
+	l.trans = nil
+}
+
+// 记录执行次数, 供虚拟机池判断是否需要重建
+func (l *LuaVM) record() {
+	l.execs++
+}
+
+// registrySize 寄存器栈当前的容量, 即虚拟机创建以来执行中用到的最大深度.
+// gopher-lua没有公开寄存器栈, 这里通过反射读取
+func registrySize(L *lua.LState) int {
+	reg := reflect.ValueOf(L).Elem().FieldByName("reg")
+	if !reg.IsValid() || reg.IsNil() {
+		return 0
+	}
+	array := reg.Elem().FieldByName("array")
+	if !array.IsValid() {
+		return 0
+	}
+	return array.Cap()
+}
+
+// loadFile 加载lua文件, 优先使用虚拟机池共享的编译缓存
+func (l *LuaVM) loadFile(fp string) (*lua.LFunction, error) {
+	if l.scripts == nil {
+		proto, err := compileFile(l.fsys, fp)
+		if err != nil {
+			return nil, err
+		}
+		return l.l.NewFunctionFromProto(proto), nil
+	}
+	proto, err := l.scripts.load(fp)
+	if err != nil {
+		return nil, err
+	}
+	return l.l.NewFunctionFromProto(proto), nil
+}
+
+// observe 记录执行耗时和返回的errNo
+func (l *LuaVM) observe(busi, trancode string, start time.Time, errNo string, err error) {
+	if l.stats != nil {
+		l.stats.observeExec(busi, trancode, time.Since(start), errNo, err)
+	}
 }
 
 // 添加mysql事务状态
@@ -323,8 +460,11 @@ func (l *LuaVM) Reset() {
 func (l *LuaVM) Clean() {
 	//清除堆栈和全局变量
 	l.l.SetTop(0)
-	//TODO 这里清除全局变量后lua无法定义全局变量,待查
-	//l.l.G.Global = l.l.CreateTable(0, 64)
+	//不能直接替换G.Global, 已加载的函数仍引用原来的全局表,
+	//这里按初始化时的快照原地还原
+	if l.snap != nil {
+		l.snap.restore(l.l)
+	}
 	l.easy = l.NewLuaTable()
 	l.easyInit = false
 }
@@ -348,6 +488,13 @@ type Logger interface {
 	Trace(format string, a ...interface{})
 }
 
+// stdLogger 未设置Logger时使用标准库log输出
+type stdLogger struct{}
+
+func (stdLogger) Error(format string, a ...interface{}) { log.Printf("[ERROR] "+format, a...) }
+func (stdLogger) Warn(format string, a ...interface{})  { log.Printf("[WARN] "+format, a...) }
+func (stdLogger) Trace(format string, a ...interface{}) { log.Printf("[TRACE] "+format, a...) }
+
 // 加入easy全局对象
 func (l *LuaVM) initEasy() {
 	l.SetGlobal("easy", l.easy)
@@ -360,31 +507,56 @@ func (l *LuaVM) SetEasyAttr(name string, value lua.LValue) {
 
 // LuaPool lua虚拟机池
 type LuaPool struct {
-	m     sync.Mutex
-	saved []*LuaVM
-	conf  *luaConfig
-	//mysql插件
-	my *luaMySQL
-	//mssql插件
-	ms *luaMsSQL
-	//sqlite插件
-	sl *luaSqlite
-	//redis插件
-	redis *luaRedis
-	//mongodb插件
-	mgo *luaMgo
+	//MaxActive 池内最多存在的虚拟机数量(空闲+使用中), 0为不限制
+	//达到上限后Get将阻塞直到有虚拟机归还
+	MaxActive int
+	//MaxIdle 池内最多保留的空闲虚拟机数量, 超出的虚拟机在Put时关闭, 0为不限制
+	MaxIdle int
+	//MinIdle 初始化时预先创建的空闲虚拟机数量
+	MinIdle int
+	//MaxExecutions 虚拟机执行脚本达到此次数后在Put时销毁并重建, 0为不限制
+	MaxExecutions int
+	//MaxStackSize 虚拟机寄存器栈在执行中增长超过此值(槽位数)后在Put时销毁并重建, 0为不限制.
+	//寄存器栈初始为1024, 最大为lua.RegistrySize, 超过最大值时脚本报错
+	MaxStackSize int
+	//MaxGlobals 虚拟机全局变量数量超过此值后在Put时销毁并重建, 0为不限制
+	MaxGlobals int
+	//DisableScriptCache 关闭脚本编译缓存, DoFile每次都重新读取编译, 用于开发环境
+	DisableScriptCache bool
+	//ExecTimeout DoFile/DoString未指定截止时间时的执行超时时间, 0为不限制
+	ExecTimeout time.Duration
+
+	m       sync.Mutex
+	saved   []*LuaVM
+	active  int           //当前存在的虚拟机数量
+	notify  chan struct{} //有虚拟机归还时关闭,用于唤醒等待者
+	closed  bool          //已调用Shutdown,不再分配虚拟机
+	once    sync.Once     //保证插件只关闭一次
+	conf    *luaConfig
+	stats   *poolStats
+	scripts *scriptCache
+	fsys    fs.FS //脚本根目录
+	reload  reloadState
+	logger  Logger
+	quit    chan struct{} //Shutdown时关闭,停止后台goroutine
+	plugins []Plugin      //已注册的插件,按注册顺序初始化
+	hooks   poolHooks     //OnCreate/OnGet/OnPut注册的函数
 }
 
 //NewLuaPool 用法
 /*
-	func MyWorker() {
-  		L := luaPool.Get()
+	func MyWorker(ctx context.Context) error {
+  		L, err := luaPool.GetContext(ctx)
+  		if err != nil {
+  			return err
+  		}
    		defer luaPool.Put(L)
+   		...
 	}
 
 	func main() {
 		luaPool := NewLuaPool()
-		defer luaPool.Shutdown()
+		defer luaPool.Shutdown(context.Background())
 
     	go MyWorker()
     	go MyWorker()
@@ -395,19 +567,43 @@ func NewLuaPool() *LuaPool {
 	p := new(LuaPool)
 	p.saved = make([]*LuaVM, 0, 10000)
 	p.conf = new(luaConfig)
+	p.stats = newPoolStats()
+	p.fsys = osFS{}
+	p.scripts = newScriptCache(p.fsys)
+	p.logger = stdLogger{}
+	p.quit = make(chan struct{})
+	//每个已注册的数据库方言一个插件
+	for _, name := range dialectNames() {
+		p.plugins = append(p.plugins, newLuaSQL(name))
+	}
+	p.plugins = append(p.plugins, newLuaRedis(), newLuaMgo())
 	return p
 }
 
+// SetLogger 设置日志接口, 脚本中的sql日志和虚拟机池的事件都将输出到此接口,
+// 需要在Init之前调用
+func (pl *LuaPool) SetLogger(logger Logger) {
+	pl.logger = logger
+}
+
+// SetFS 设置脚本根目录, DoFile从fsys中加载 busi/trancode/main.lua,
+// require只在 busi 目录下查找. fsys可以是os.DirFS、embed.FS或zip.Reader,
+// 未设置时按进程工作目录加载. 需要在取出虚拟机之前调用
+func (pl *LuaPool) SetFS(fsys fs.FS) {
+	pl.fsys = fsys
+	pl.scripts = newScriptCache(fsys)
+}
+
 // InitFromFile 初始化lua容器,必须调用.
 func (pl *LuaPool) InitFromFile(file string) (err error) {
 	//读取配置文件
 	if err = pl.conf.LoadFromFile(file); err != nil {
 		return
 	}
-	if err = pl.initDB(); err != nil {
+	if err = pl.initPlugins(); err != nil {
 		return
 	}
-	return nil
+	return pl.initPool()
 }
 
 // InitFromConf 初始化lua容器,必须调用.
@@ -416,85 +612,286 @@ func (pl *LuaPool) InitFromConf(conf string) (err error) {
 	if err = pl.conf.LoadFromConf(conf); err != nil {
 		return
 	}
-	if err = pl.initDB(); err != nil {
+	if err = pl.initPlugins(); err != nil {
 		return
 	}
-	return nil
+	return pl.initPool()
 }
 
-// InitDB 初始化数据库
-func (pl *LuaPool) initDB() (err error) {
-	//初始化mysql插件
-	pl.my = newLuaMySQL()
-	if err = pl.my.Init(pl.conf.SQLS); err != nil {
-		return
+// initPool 读取配置文件中的池容量并预先创建MinIdle个虚拟机,
+// 配置文件中未设置的项保留代码中设置的值
+func (pl *LuaPool) initPool() error {
+	c := pl.conf.Pool
+	if c.MaxActive > 0 {
+		pl.MaxActive = c.MaxActive
 	}
-	//初适化mssql插件
-	pl.ms = newLuaMsSQL()
-	if err = pl.ms.Init(pl.conf.SQLS); err != nil {
-		return
+	if c.MaxIdle > 0 {
+		pl.MaxIdle = c.MaxIdle
 	}
-	//初适化sqlite插件
-	pl.sl = newLuaSqlite()
-	if err = pl.sl.Init(pl.conf.SQLS); err != nil {
-		return
+	if c.MinIdle > 0 {
+		pl.MinIdle = c.MinIdle
 	}
-	//初始化redis插件
-	re := pl.conf.Redis
-	pl.redis = newLuaRedis()
-	if err = pl.redis.Init(re.Addr, re.Passwd, re.DataBase); err != nil {
-		return
+	if c.MaxExecutions > 0 {
+		pl.MaxExecutions = c.MaxExecutions
 	}
-	//初始化mongodb插件
-	mg := pl.conf.Mongodb
-	pl.mgo = newLuaMgo()
-	if err = pl.mgo.Init(mg.Addr, mg.User, mg.Passwd); err != nil {
-		return
+	if c.MaxStackSize > 0 {
+		pl.MaxStackSize = c.MaxStackSize
+	}
+	if c.MaxGlobals > 0 {
+		pl.MaxGlobals = c.MaxGlobals
+	}
+	if c.DisableScriptCache {
+		pl.DisableScriptCache = true
+	}
+	if c.ExecTimeout > 0 {
+		pl.ExecTimeout = c.ExecTimeout
+	}
+
+	pl.m.Lock()
+	defer pl.m.Unlock()
+	for len(pl.saved) < pl.MinIdle {
+		if pl.MaxActive > 0 && pl.active >= pl.MaxActive {
+			break
+		}
+		L, err := pl.new()
+		if err != nil {
+			return err
+		}
+		pl.saved = append(pl.saved, L)
+		pl.active++
 	}
 	return nil
 }
 
-// Get 如果没有则会新建
+// Get 如果没有空闲虚拟机且未达到MaxActive则会新建,
+// 达到MaxActive时阻塞直到有虚拟机归还, 池已关闭时返回nil
 func (pl *LuaPool) Get() *LuaVM {
-	pl.m.Lock()
-	defer pl.m.Unlock()
+	L, _ := pl.GetContext(context.Background())
+	return L
+}
 
-	n := len(pl.saved)
-	if n == 0 {
-		return pl.new()
+// GetContext 同Get, 达到MaxActive时阻塞直到有虚拟机归还或ctx结束,
+// ctx结束时返回错误, 池已关闭时返回ErrPoolClosed
+func (pl *LuaPool) GetContext(ctx context.Context) (*LuaVM, error) {
+	start := time.Now()
+	defer func() { pl.stats.observeWait(time.Since(start)) }()
+	for {
+		pl.m.Lock()
+		if pl.closed {
+			pl.m.Unlock()
+			return nil, ErrPoolClosed
+		}
+		if n := len(pl.saved); n > 0 {
+			x := pl.saved[n-1]
+			pl.saved = pl.saved[0 : n-1]
+			pl.m.Unlock()
+			x, err := pl.refresh(x)
+			if err != nil {
+				pl.m.Lock()
+				pl.active--
+				pl.wakeup()
+				pl.m.Unlock()
+				return nil, err
+			}
+			return pl.checkout(x)
+		}
+		if pl.MaxActive <= 0 || pl.active < pl.MaxActive {
+			pl.active++
+			pl.m.Unlock()
+			x, err := pl.new()
+			if err != nil {
+				pl.m.Lock()
+				pl.active--
+				pl.wakeup()
+				pl.m.Unlock()
+				return nil, err
+			}
+			return pl.checkout(x)
+		}
+		if pl.notify == nil {
+			pl.notify = make(chan struct{})
+		}
+		notify := pl.notify
+		pl.m.Unlock()
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("获取虚拟机失败,已达到最大数量[%d]: %w", pl.MaxActive, ctx.Err())
+		}
 	}
-	x := pl.saved[n-1]
-	pl.saved = pl.saved[0 : n-1]
-	return x
 }
 
 type tranfunc string
 
-// 这里将加载lua库和初始化easy全局变量
-func (pl *LuaPool) new() *LuaVM {
+// luaContext 获取脚本执行的context, 未设置时返回context.Background()
+func luaContext(L *lua.LState) context.Context {
+	if ctx := L.Context(); ctx != nil {
+		return ctx
+	}
+	return context.Background()
+}
+
+// 这里将加载lua库和初始化easy全局变量, OnCreate失败时关闭虚拟机并返回错误
+func (pl *LuaPool) new() (*LuaVM, error) {
 	L := NewLuaVM(pl.conf)
-	L.LoadLibs(pl.my.Loader, pl.ms.Loader, pl.sl.Loader,
-		pl.redis.Loader, pl.mgo.Loader)
+	L.LoadLibs(pl.plugins...)
 	L.easy = L.NewLuaTable()
 	//初始化context
-	ctx := mapCtx.WithValue(context.Background(), tranfunc("addTran"), L.addTran)
-	L.l.SetContext(ctx)
-	return L
+	L.logger = pl.logger
+	L.timeout = pl.ExecTimeout
+	L.l.SetContext(L.withValues(context.Background()))
+	L.gen = pl.reload.current()
+	L.stats = pl.stats
+	L.fsys = pl.fsys
+	if !pl.DisableScriptCache {
+		L.scripts = pl.scripts
+	}
+	L.installLoader()
+	if err := pl.hooks.create(L); err != nil {
+		L.Close()
+		return nil, err
+	}
+	//记录初始的全局环境,归还时还原
+	L.snapshot()
+	pl.stats.addCreated()
+	return L, nil
+}
+
+// expired 虚拟机执行次数或状态大小超过限制, 或在脚本重新加载之前创建时需要重建
+func (pl *LuaPool) expired(L *LuaVM) bool {
+	if pl.MaxExecutions > 0 && L.execs >= pl.MaxExecutions {
+		return true
+	}
+	//Watch发现脚本变化之前创建的虚拟机
+	if L.gen != pl.reload.current() {
+		return true
+	}
+	if pl.MaxStackSize > 0 && registrySize(L.l) > pl.MaxStackSize {
+		return true
+	}
+	if pl.MaxGlobals > 0 {
+		n := 0
+		L.l.G.Global.ForEach(func(lua.LValue, lua.LValue) { n++ })
+		if n > pl.MaxGlobals {
+			return true
+		}
+	}
+	return false
 }
 
-// Put ...
+// Put 归还虚拟机, 空闲数量超过MaxIdle或池已关闭时直接关闭,
+// 超过MaxExecutions/MaxStackSize/MaxGlobals或Watch发现脚本变化之前创建的虚拟机
+// 将被关闭并替换为新的虚拟机
 func (pl *LuaPool) Put(L *LuaVM) {
-	L.Clean()
+	pl.m.Lock()
+	closed := pl.closed
+	pl.m.Unlock()
+	if closed {
+		pl.release(L)
+		return
+	}
+	if err := pl.hooks.put(L); err != nil {
+		pl.logger.Warn("%v", err)
+		pl.release(L)
+		return
+	}
+
+	if pl.expired(L) {
+		pl.destroy(L)
+		var err error
+		if L, err = pl.new(); err != nil {
+			pl.logger.Warn("%v", err)
+			pl.m.Lock()
+			pl.active--
+			pl.wakeup()
+			pl.m.Unlock()
+			return
+		}
+	} else {
+		L.Clean()
+	}
 	//放入对象池
 	pl.m.Lock()
 	defer pl.m.Unlock()
 
-	pl.saved = append(pl.saved, L)
+	if pl.closed || pl.MaxIdle > 0 && len(pl.saved) >= pl.MaxIdle {
+		pl.destroy(L)
+		pl.active--
+	} else {
+		pl.saved = append(pl.saved, L)
+	}
+	pl.wakeup()
 }
 
-// Shutdown 关闭池内的所以虚拟机
-func (pl *LuaPool) Shutdown() {
-	for _, L := range pl.saved {
-		L.Close()
+// release 关闭一个已取出的虚拟机并唤醒等待者
+func (pl *LuaPool) release(L *LuaVM) {
+	pl.destroy(L)
+	pl.m.Lock()
+	pl.active--
+	pl.wakeup()
+	pl.m.Unlock()
+}
+
+// wakeup 唤醒等待的Get和Shutdown, 调用时必须持有pl.m
+func (pl *LuaPool) wakeup() {
+	if pl.notify != nil {
+		close(pl.notify)
+		pl.notify = nil
 	}
 }
+
+// destroy 关闭虚拟机并计数
+func (pl *LuaPool) destroy(L *LuaVM) {
+	L.Close()
+	pl.stats.addDestroyed()
+}
+
+// Shutdown 关闭虚拟机池, 之后Get将返回ErrPoolClosed.
+// 等待所有已取出的虚拟机归还或ctx结束后关闭所有数据库连接和缓存,
+// ctx结束时仍会关闭插件, 并返回ctx的错误
+func (pl *LuaPool) Shutdown(ctx context.Context) (err error) {
+	pl.m.Lock()
+	pl.closed = true
+	for {
+		//关闭空闲的虚拟机
+		for _, L := range pl.saved {
+			pl.destroy(L)
+			pl.active--
+		}
+		pl.saved = nil
+		if pl.active <= 0 {
+			break
+		}
+		if pl.notify == nil {
+			pl.notify = make(chan struct{})
+		}
+		notify := pl.notify
+		pl.m.Unlock()
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			err = fmt.Errorf("等待虚拟机归还超时,剩余[%d]: %w", pl.InUse(), ctx.Err())
+		}
+		pl.m.Lock()
+		if err != nil {
+			break
+		}
+	}
+	pl.wakeup()
+	pl.m.Unlock()
+
+	pl.once.Do(func() {
+		close(pl.quit)
+		pl.closePlugins()
+	})
+	return err
+}
+
+// InUse 当前已取出未归还的虚拟机数量
+func (pl *LuaPool) InUse() int {
+	pl.m.Lock()
+	defer pl.m.Unlock()
+	return pl.active - len(pl.saved)
+}
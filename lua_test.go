@@ -1,8 +1,11 @@
 package luavm
 
 import (
+	"context"
+	"errors"
 	"strconv"
 	"testing"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	lua "github.com/yuin/gopher-lua"
@@ -226,6 +229,260 @@ func typeConvert(t *testing.T) {
 
 }
 
+func TestLuaPoolBounded(t *testing.T) {
+	pool := NewLuaPool()
+	pool.MaxActive = 2
+	pool.MaxIdle = 1
+
+	vm1 := pool.Get()
+	vm2 := pool.Get()
+	//已达到最大数量,等待超时返回错误
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if vm, err := pool.GetContext(ctx); err == nil {
+		t.Fatalf("超过MaxActive仍然获取到虚拟机 %p", vm)
+	}
+
+	//归还后等待者应被唤醒
+	done := make(chan *LuaVM)
+	go func() {
+		vm, err := pool.GetContext(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		done <- vm
+	}()
+	time.Sleep(10 * time.Millisecond)
+	pool.Put(vm1)
+	select {
+	case vm := <-done:
+		if vm != vm1 {
+			t.Fatal("等待者未获取到归还的虚拟机")
+		}
+		pool.Put(vm)
+	case <-time.After(time.Second):
+		t.Fatal("归还虚拟机后等待者未被唤醒")
+	}
+
+	//超过MaxIdle的虚拟机将被关闭
+	pool.Put(vm2)
+	if n := len(pool.saved); n != 1 {
+		t.Fatalf("空闲虚拟机数量不符[%d]", n)
+	}
+	if pool.active != 1 {
+		t.Fatalf("虚拟机总数不符[%d]", pool.active)
+	}
+}
+
+func TestLuaPoolRecycle(t *testing.T) {
+	pool := NewLuaPool()
+	pool.MaxExecutions = 2
+
+	vm := pool.Get()
+	for i := 0; i < 2; i++ {
+		if _, _, err := vm.DoString(`local m = 1`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pool.Put(vm)
+	//达到执行次数的虚拟机应被替换
+	if n := len(pool.saved); n != 1 {
+		t.Fatalf("空闲虚拟机数量不符[%d]", n)
+	}
+	if pool.saved[0] == vm {
+		t.Fatal("达到MaxExecutions的虚拟机未被替换")
+	}
+
+	vm = pool.Get()
+	if _, _, err := vm.DoString(`local m = 1`); err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(vm)
+	if pool.saved[0] != vm {
+		t.Fatal("未达到MaxExecutions的虚拟机被替换")
+	}
+
+	//执行中寄存器栈增长超过MaxStackSize的虚拟机应被替换
+	pool.MaxExecutions = 0
+	pool.MaxStackSize = 2000
+	vm = pool.Get()
+	if _, _, err := vm.DoString(`local t = {}; for i = 1, 3000 do t[i] = i end; local n = select("#", unpack(t))`); err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(vm)
+	if pool.saved[0] == vm {
+		t.Fatal("超过MaxStackSize的虚拟机未被替换")
+	}
+}
+
+func TestLuaPoolReset(t *testing.T) {
+	pool := NewLuaPool()
+	pool.OnCreate(func(vm *LuaVM) error {
+		_, _, err := vm.DoString(`config = {db = {opts = {name = "main"}}}`)
+		return err
+	})
+
+	vm := pool.Get()
+	script := `
+			leak = "leak"
+			string.leak = function() return "leak" end
+			math.pi = 3
+			config.db.opts.name = "leak"
+			local json = require("json")
+			json.leak = true
+			package.preload.counter = function()
+				local n = 0
+				return {inc = function() n = n + 1 return n end}
+			end
+			require("counter").inc()
+			setmetatable(_G, {__index = function() return "leak" end})
+		`
+	if _, _, err := vm.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(vm)
+
+	//同一个虚拟机再次取出时应与新建的一致
+	if vm2 := pool.Get(); vm2 != vm {
+		t.Fatal("未取到归还的虚拟机")
+	}
+	script = `
+			if rawget(_G, "leak") ~= nil or leak ~= nil then
+				error("全局变量未清除")
+			end
+			if string.leak ~= nil then
+				error("string库新增函数未清除")
+			end
+			if math.pi == 3 then
+				error("math库修改未还原")
+			end
+			if config.db.opts.name ~= "main" then
+				error("多层table的修改未还原")
+			end
+			if package.loaded.json ~= nil or package.loaded.counter ~= nil or package.preload.counter ~= nil then
+				error("创建后加载的模块未移除")
+			end
+			if require("json").leak ~= nil then
+				error("模块的修改未还原")
+			end
+			if type(bigint) ~= "function" then
+				error("bigint库被清除")
+			end
+			loaded_json = require("json")
+		`
+	if _, _, err := vm.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+	//模块在归还后重新加载, 不会保留上一次执行的状态
+	first := vm.GetGlobal("loaded_json")
+	pool.Put(vm)
+	vm = pool.Get()
+	defer pool.Put(vm)
+	if _, _, err := vm.DoString(`loaded_json = require("json")`); err != nil {
+		t.Fatal(err)
+	}
+	if vm.GetGlobal("loaded_json") == first {
+		t.Fatal("归还后模块未重新加载")
+	}
+}
+
+func TestLuaPoolShutdown(t *testing.T) {
+	pool := NewLuaPool()
+	vm := pool.Get()
+	pool.Put(pool.Get())
+
+	//有虚拟机未归还,等待超时
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := pool.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown未等待虚拟机归还 %v", err)
+	}
+	if _, err := pool.GetContext(context.Background()); err != ErrPoolClosed {
+		t.Fatalf("关闭后仍可获取虚拟机 %v", err)
+	}
+
+	//归还后Shutdown应立即返回
+	done := make(chan error)
+	go func() { done <- pool.Shutdown(context.Background()) }()
+	time.Sleep(10 * time.Millisecond)
+	pool.Put(vm)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("虚拟机归还后Shutdown未返回")
+	}
+	if st := pool.Stats(); st.Created != st.Destroyed || st.Idle != 0 || st.InUse != 0 {
+		t.Fatalf("关闭后虚拟机未全部销毁 %+v", st)
+	}
+}
+
+func TestExecTimeout(t *testing.T) {
+	pool := NewLuaPool()
+	vm := pool.Get()
+	defer pool.Put(vm)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err := vm.DoStringContext(ctx, `while true do end`)
+	if !errors.Is(err, ErrExecTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("死循环未超时返回 %v", err)
+	}
+	//超时后虚拟机仍可继续使用
+	if errNo, _, err := vm.DoString(`return "0000"`); err != nil || errNo != "0000" {
+		t.Fatalf("超时后虚拟机不可用 %v", err)
+	}
+
+	//未指定截止时间时使用ExecTimeout
+	pool.ExecTimeout = 50 * time.Millisecond
+	vm2 := pool.Get()
+	defer pool.Put(vm2)
+	if _, _, err := vm2.DoString(`while true do end`); !errors.Is(err, ErrExecTimeout) {
+		t.Fatalf("ExecTimeout未生效 %v", err)
+	}
+}
+
+func TestLuaSandbox(t *testing.T) {
+	pool := NewLuaPool()
+	conf := `
+[Sandbox]
+Libs = ["base", "table", "string", "math", "os"]
+[Sandbox.Funcs]
+base = ["print", "pairs", "ipairs", "type", "error", "tostring", "tonumber", "setmetatable", "pcall"]
+os = ["time", "date"]
+`
+	if err := pool.conf.LoadFromConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	vm := pool.Get()
+	defer pool.Put(vm)
+	script := `
+			if io ~= nil or debug ~= nil or coroutine ~= nil then
+				error("未允许的库被加载")
+			end
+			if os.execute ~= nil or os.exit ~= nil or os.getenv ~= nil then
+				error("os库未允许的函数被加载")
+			end
+			if dofile ~= nil or loadstring ~= nil then
+				error("基本库未允许的函数被加载")
+			end
+			if type(os.time()) ~= "number" or os.date("%Y") == nil then
+				error("os库允许的函数不可用")
+			end
+			local json = require("json")
+		`
+	if _, _, err := vm.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := new(luaConfig)
+	if err := bad.LoadFromConf("[Sandbox]\nLibs = [\"net\"]"); err == nil {
+		t.Fatal("未知的库名未报错")
+	}
+}
+
 func BenchmarkLua(b *testing.B) {
 	b.ReportAllocs()
 	b.RunParallel(func(pb *testing.PB) {
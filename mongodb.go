@@ -1,7 +1,12 @@
 package luavm
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"time"
+
+	"luavm/internal/number"
 
 	"github.com/yuin/gluamapper"
 	"gopkg.in/mgo.v2/bson"
@@ -10,52 +15,207 @@ import (
 	"gopkg.in/mgo.v2"
 )
 
+//mgoConfig 配置文件中的[Mongodb]或[[Mongodb]]
+type mgoConfig struct {
+	Name   string
+	Addr   string
+	User   string
+	Passwd string
+}
+
+//mgoInstance 一个mongodb实例的连接
+type mgoInstance struct {
+	name string
+	conn *mgo.Session
+}
+
 //luaMgo mongodb插件
+//
+//	[[Mongodb]]
+//	Name = "log"
+//	Addr = "127.0.0.1:27017"
+//
+//	local mongodb = require("mongodb")
+//	local client = mongodb.connect("log")
+//	local coll = client:collection("test", "easy")
+//	coll:find({name = "lisi"})
+//	mongodb.find("test", "easy", {}) --使用default实例
 type luaMgo struct {
-	conn *mgo.Session
+	confs     []*mgoConfig
+	instances map[string]*mgoInstance
 }
 
 //newLuaMgo ...
 func newLuaMgo() *luaMgo {
 	m := new(luaMgo)
+	m.instances = make(map[string]*mgoInstance, 4)
 	return m
 }
 
-//Init 初始化mongodb插件
-func (m *luaMgo) Init(addr, user, passwd string) (err error) {
-	conn, err := mgo.Dial(addr)
+//Name 插件名
+func (m *luaMgo) Name() string { return "mongodb" }
+
+//Decode 读取配置文件中的[Mongodb]或[[Mongodb]]
+func (m *luaMgo) Decode(conf *PluginConfig) (err error) {
+	m.confs, _, err = decodeInstances[mgoConfig](conf, "Mongodb")
+	return
+}
+
+//Init 初始化mongodb插件, 连接每个实例
+func (m *luaMgo) Init() (err error) {
+	for _, c := range m.confs {
+		name := c.Name
+		if name == "" {
+			name = defaultInstance
+		}
+		if _, ok := m.instances[name]; ok {
+			return fmt.Errorf("mongodb实例[%s]重复", name)
+		}
+		conn, err := dialMgo(c)
+		if err != nil {
+			return fmt.Errorf("mongodb实例[%s]: %v", name, err)
+		}
+		m.instances[name] = &mgoInstance{name: name, conn: conn}
+	}
+	return nil
+}
+
+func dialMgo(c *mgoConfig) (*mgo.Session, error) {
+	conn, err := mgo.Dial(c.Addr)
 	if err != nil {
-		return
+		return nil, err
 	}
 	auth := &mgo.Credential{
-		Username: user,
-		Password: passwd,
+		Username: c.User,
+		Password: c.Passwd,
 	}
-	err = conn.Login(auth)
-	if err != nil {
-		return
+	if err = conn.Login(auth); err != nil {
+		conn.Close()
+		return nil, err
 	}
 
 	conn.SetMode(mgo.Strong, true)
 	conn.SetPoolLimit(128)
-	m.conn = conn
+	return conn, nil
+}
+
+//Close 关闭所有mongodb连接
+func (m *luaMgo) Close() error {
+	for _, inst := range m.instances {
+		inst.conn.Close()
+	}
 	return nil
 }
 
-//Loader ...
+//Health 检查所有mongodb实例
+func (m *luaMgo) Health(ctx context.Context) error {
+	for name, inst := range m.instances {
+		session := inst.conn.Copy()
+		if deadline, ok := ctx.Deadline(); ok {
+			session.SetSyncTimeout(time.Until(deadline))
+		}
+		err := session.Ping()
+		session.Close()
+		if err != nil {
+			return fmt.Errorf("mongodb实例[%s]: %v", name, err)
+		}
+	}
+	return nil
+}
+
+//session 复制一个会话, 脚本的context设置了截止时间时作为会话的超时时间
+func (c *mgoInstance) session(L *lua.LState) (*mgo.Session, error) {
+	ctx := luaContext(L)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	session := c.conn.Copy()
+	if deadline, ok := ctx.Deadline(); ok {
+		d := time.Until(deadline)
+		session.SetSocketTimeout(d)
+		session.SetSyncTimeout(d)
+	}
+	return session, nil
+}
+
+//mgoCommands lua中可以调用的mongodb操作, 前两个参数为数据库名和集合名
+var mgoCommands = map[string]func(*mgoInstance, *lua.LState) int{
+	"insert":  (*mgoInstance).insert,
+	"update":  (*mgoInstance).update,
+	"remove":  (*mgoInstance).remove,
+	"find":    (*mgoInstance).find,
+	"findone": (*mgoInstance).findone,
+}
+
+//Loader 模块函数使用default实例, connect获取其他实例
 func (m *luaMgo) Loader(L *lua.LState) int {
-	var exports = map[string]lua.LGFunction{
-		"insert":  m.insert,
-		"update":  m.update,
-		"remove":  m.remove,
-		"find":    m.find,
-		"findone": m.findone,
-	}
-	mod := L.SetFuncs(L.NewTable(), exports)
+	if len(m.instances) == 0 {
+		return notConfigured(L, "mongodb")
+	}
+	mod := L.NewTable()
+	mod.RawSetString("connect", L.NewFunction(m.connect))
+	for name, cmd := range mgoCommands {
+		cmd := cmd
+		mod.RawSetString(name, L.NewFunction(func(L *lua.LState) int {
+			inst := m.instances[defaultInstance]
+			if inst == nil {
+				L.RaiseError("mongodb实例[%s]不存在", defaultInstance)
+			}
+			return cmd(inst, L)
+		}))
+	}
 	L.Push(mod)
 	return 1
 }
 
+//connect 获取指定名称的mongodb实例, 返回的client可以直接调用操作,
+//或通过 client:collection(db, coll) 获取集合对象
+func (m *luaMgo) connect(L *lua.LState) int {
+	name := L.CheckString(1)
+	inst := m.instances[name]
+	if inst == nil {
+		pushTwoError(fmt.Errorf("mongodb实例[%s]不存在", name), L)
+		return 2
+	}
+	client := L.NewTable()
+	for name, cmd := range mgoCommands {
+		client.RawSetString(name, bindMethod(L, client, inst, cmd))
+	}
+	client.RawSetString("collection", L.NewFunction(func(L *lua.LState) int {
+		if L.Get(1) == client {
+			L.Remove(1)
+		}
+		L.Push(inst.collection(L, L.CheckString(1), L.CheckString(2)))
+		return 1
+	}))
+	L.Push(client)
+	return 1
+}
+
+//collection 集合对象, 调用操作时自动补上数据库名和集合名
+func (c *mgoInstance) collection(L *lua.LState, dbname, cname string) *lua.LTable {
+	coll := L.NewTable()
+	for name, cmd := range mgoCommands {
+		cmd := cmd
+		coll.RawSetString(name, bindMethod(L, coll, c, func(c *mgoInstance, L *lua.LState) int {
+			L.Insert(lua.LString(cname), 1)
+			L.Insert(lua.LString(dbname), 1)
+			return cmd(c, L)
+		}))
+	}
+	return coll
+}
+
+//bindMethod 将操作绑定到对象上, 支持 obj.fn() 和 obj:fn() 两种调用方式
+func bindMethod(L *lua.LState, self *lua.LTable, inst *mgoInstance, cmd func(*mgoInstance, *lua.LState) int) *lua.LFunction {
+	return L.NewFunction(func(L *lua.LState) int {
+		if L.Get(1) == self {
+			L.Remove(1)
+		}
+		return cmd(inst, L)
+	})
+}
+
 func getOneValue(L *lua.LState) (dbname string, cname string, arg bson.M, err error) {
 	num := L.GetTop()
 	if num != 3 {
@@ -77,6 +237,7 @@ func getOneValue(L *lua.LState) (dbname string, cname string, arg bson.M, err er
 		if err = gluamapper.Map(value.(*lua.LTable), &arg); err != nil {
 			return
 		}
+		mgoArgs(arg)
 	case lua.LTString:
 		if err = bson.UnmarshalJSON([]byte(value.String()), &arg); err != nil {
 			return
@@ -109,6 +270,7 @@ func getTwoValue(L *lua.LState) (dbname string, cname string, argone bson.M, arg
 		if err = gluamapper.Map(value.(*lua.LTable), &argone); err != nil {
 			return
 		}
+		mgoArgs(argone)
 	case lua.LTString:
 		if err = bson.UnmarshalJSON([]byte(value.String()), &argone); err != nil {
 			return
@@ -124,6 +286,7 @@ func getTwoValue(L *lua.LState) (dbname string, cname string, argone bson.M, arg
 		if err = gluamapper.Map(value.(*lua.LTable), &argtwo); err != nil {
 			return
 		}
+		mgoArgs(argtwo)
 	case lua.LTString:
 		if err = bson.UnmarshalJSON([]byte(value.String()), &argtwo); err != nil {
 			return
@@ -135,6 +298,58 @@ func getTwoValue(L *lua.LState) (dbname string, cname string, argone bson.M, arg
 	return
 }
 
+//mgoValue 将查询结果转换为lua值, 超过2^53的整数和Decimal128不丢失精度
+func mgoValue(value interface{}) lua.LValue {
+	switch v := value.(type) {
+	case int:
+		return number.FromInt64(int64(v))
+	case int64:
+		return number.FromInt64(v)
+	case float32:
+		return lua.LNumber(float64(v))
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case bson.Decimal128:
+		if lv, err := number.FromString(v.String()); err == nil {
+			return lv
+		}
+	}
+	return lua.LString(fmt.Sprintf("%v", value))
+}
+
+//mgoArgs 将参数中的int64、decimal转换为int64和Decimal128, 直接修改v
+func mgoArgs(v interface{}) interface{} {
+	switch x := v.(type) {
+	case *lua.LUserData:
+		n, ok := number.ToGo(x)
+		if !ok {
+			return v
+		}
+		if s, ok := n.(json.Number); ok {
+			if d, err := bson.ParseDecimal128(string(s)); err == nil {
+				return d
+			}
+			return string(s)
+		}
+		return n
+	case bson.M:
+		for k, e := range x {
+			x[k] = mgoArgs(e)
+		}
+	case map[interface{}]interface{}:
+		for k, e := range x {
+			x[k] = mgoArgs(e)
+		}
+	case []interface{}:
+		for i, e := range x {
+			x[i] = mgoArgs(e)
+		}
+	}
+	return v
+}
+
 func pushErr(err error, L *lua.LState) {
 	L.Push(lua.LString(err.Error()))
 	return
@@ -145,8 +360,12 @@ func pushTwoError(err error, L *lua.LState) {
 	return
 }
 
-func (m *luaMgo) insert(L *lua.LState) int {
-	session := m.conn.Copy()
+func (c *mgoInstance) insert(L *lua.LState) int {
+	session, err := c.session(L)
+	if err != nil {
+		pushErr(err, L)
+		return 1
+	}
 	defer session.Close()
 
 	dbname, cname, cmd, err := getOneValue(L)
@@ -161,8 +380,12 @@ func (m *luaMgo) insert(L *lua.LState) int {
 	return 0
 }
 
-func (m *luaMgo) update(L *lua.LState) int {
-	session := m.conn.Copy()
+func (c *mgoInstance) update(L *lua.LState) int {
+	session, err := c.session(L)
+	if err != nil {
+		pushErr(err, L)
+		return 1
+	}
 	defer session.Close()
 	dbname, cname, argone, argtwo, err := getTwoValue(L)
 	if err != nil {
@@ -177,8 +400,12 @@ func (m *luaMgo) update(L *lua.LState) int {
 	return 0
 }
 
-func (m *luaMgo) remove(L *lua.LState) int {
-	session := m.conn.Copy()
+func (c *mgoInstance) remove(L *lua.LState) int {
+	session, err := c.session(L)
+	if err != nil {
+		pushErr(err, L)
+		return 1
+	}
 	defer session.Close()
 
 	dbname, cname, cmd, err := getOneValue(L)
@@ -193,8 +420,12 @@ func (m *luaMgo) remove(L *lua.LState) int {
 	return 0
 }
 
-func (m *luaMgo) find(L *lua.LState) int {
-	session := m.conn.Copy()
+func (c *mgoInstance) find(L *lua.LState) int {
+	session, err := c.session(L)
+	if err != nil {
+		pushTwoError(err, L)
+		return 2
+	}
 	defer session.Close()
 
 	dbname, cname, cmd, err := getOneValue(L)
@@ -218,20 +449,7 @@ func (m *luaMgo) find(L *lua.LState) int {
 	for _, doc := range result {
 		one := L.NewTable()
 		for key, value := range doc {
-			var v lua.LValue
-			switch value.(type) {
-			case int:
-				v = lua.LNumber(float64(value.(int)))
-			case float32:
-				v = lua.LNumber(float64(value.(float32)))
-			case float64:
-				v = lua.LNumber(value.(float64))
-			case string:
-				v = lua.LString(value.(string))
-			default:
-				v = lua.LString(fmt.Sprintf("%v", value))
-			}
-			one.RawSetString(key, v)
+			one.RawSetString(key, mgoValue(value))
 		}
 		table.RawSetInt(index, one)
 		index++
@@ -240,8 +458,12 @@ func (m *luaMgo) find(L *lua.LState) int {
 	return 1
 }
 
-func (m *luaMgo) findone(L *lua.LState) int {
-	session := m.conn.Copy()
+func (c *mgoInstance) findone(L *lua.LState) int {
+	session, err := c.session(L)
+	if err != nil {
+		pushTwoError(err, L)
+		return 2
+	}
 	defer session.Close()
 	dbname, cname, cmd, err := getOneValue(L)
 	if err != nil {
@@ -255,20 +477,7 @@ func (m *luaMgo) findone(L *lua.LState) int {
 	}
 	table := L.NewTable()
 	for key, value := range result {
-		var v lua.LValue
-		switch value.(type) {
-		case int:
-			v = lua.LNumber(float64(value.(int)))
-		case float32:
-			v = lua.LNumber(float64(value.(float32)))
-		case float64:
-			v = lua.LNumber(value.(float64))
-		case string:
-			v = lua.LString(value.(string))
-		default:
-			v = lua.LString(fmt.Sprintf("%v", value))
-		}
-		table.RawSetString(key, v)
+		table.RawSetString(key, mgoValue(value))
 	}
 	L.Push(table)
 	return 1
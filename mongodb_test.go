@@ -10,7 +10,8 @@ func TestMongodb(t *testing.T) {
 	defer pool.Put(vm)
 
 	mgo := newLuaMgo()
-	if err := mgo.Init("192.168.1.30:27017", "root", "root"); err != nil {
+	mgo.confs = []*mgoConfig{{Addr: "192.168.1.30:27017", User: "root", Passwd: "root"}}
+	if err := mgo.Init(); err != nil {
 		t.Fatal(err)
 	}
 	vm.PreLoadModule("mongodb", mgo.Loader)
@@ -69,7 +70,8 @@ func BenchmarkMongodb(b *testing.B) {
 		pool := NewLuaPool()
 
 		mgo := newLuaMgo()
-		if err := mgo.Init("192.168.1.30:27017", "root", "root"); err != nil {
+		mgo.confs = []*mgoConfig{{Addr: "192.168.1.30:27017", User: "root", Passwd: "root"}}
+		if err := mgo.Init(); err != nil {
 			b.Fatal(err)
 		}
 
@@ -94,3 +96,29 @@ func BenchmarkMongodb(b *testing.B) {
 
 	})
 }
+
+func TestMongodbHandles(t *testing.T) {
+	pool := NewLuaPool()
+	vm := pool.Get()
+	defer pool.Put(vm)
+
+	//不连接数据库, 只检查lua中的对象
+	m := newLuaMgo()
+	m.instances["log"] = &mgoInstance{name: "log"}
+	vm.PreLoadModule("mongodb", m.Loader)
+	script := `
+		local mongodb = require("mongodb")
+		local client = mongodb.connect("log")
+		assert(type(client.find) == "function")
+		local coll = client:collection("test", "easy")
+		assert(type(coll.find) == "function" and type(coll.insert) == "function")
+		assert(client.collection("test", "easy"))
+		local none, err = mongodb.connect("none")
+		assert(none == nil and err ~= nil)
+		--没有default实例时模块函数报错
+		assert(not pcall(mongodb.find, "test", "easy", {}))
+	`
+	if _, _, err := vm.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+}
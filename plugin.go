@@ -0,0 +1,141 @@
+package luavm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/BurntSushi/toml"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// ErrNotConfigured 配置文件中没有插件对应的段, 脚本require该插件时返回
+var ErrNotConfigured = errors.New("后端未配置")
+
+// Plugin 虚拟机池插件, 在Init时按配置文件初始化,
+// 每个虚拟机中通过 require(Name()) 加载
+//
+//	type myPlugin struct{ conf struct{ Addr string } }
+//
+//	func (p *myPlugin) Name() string { return "my" }
+//	func (p *myPlugin) Decode(c *PluginConfig) error {
+//		_, err := c.Decode("My", &p.conf)
+//		return err
+//	}
+//	...
+//	luaPool.Register(new(myPlugin))
+type Plugin interface {
+	// Name 插件名, 即lua中require的模块名
+	Name() string
+	// Decode 从配置文件中读取插件的配置
+	Decode(conf *PluginConfig) error
+	// Init 初始化插件, 在Decode之后调用
+	Init() error
+	// Loader 模块加载函数, 每个虚拟机require时调用
+	Loader(L *lua.LState) int
+	// Health 检查插件的连接状态
+	Health(ctx context.Context) error
+	// Close 关闭插件, Shutdown时调用
+	Close() error
+}
+
+// PluginConfig 配置文件中的各个段, 插件通过Decode读取自己的段
+type PluginConfig struct {
+	md       toml.MetaData
+	sections map[string]toml.Primitive
+	conf     *luaConfig //展开字符串中的 ${ref} 引用
+}
+
+// Decode 将配置文件中名为section的段解码到v, 没有此段时返回false.
+// v中的字符串在解码后展开 ${ref} 引用
+func (c *PluginConfig) Decode(section string, v interface{}) (bool, error) {
+	if c == nil {
+		return false, nil
+	}
+	p, ok := c.sections[section]
+	if !ok {
+		return false, nil
+	}
+	if err := c.md.PrimitiveDecode(p, v); err != nil {
+		return true, fmt.Errorf("配置[%s]格式错误: %v", section, err)
+	}
+	if c.conf != nil {
+		if err := c.conf.expandFields(reflect.ValueOf(v), section); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// decodeInstances 读取可以配置为[section]或[[section]]的段, 前者视为只有一个实例
+func decodeInstances[T any](c *PluginConfig, section string) ([]*T, bool, error) {
+	var list []*T
+	ok, err := c.Decode(section, &list)
+	if !ok || err == nil {
+		return list, ok, err
+	}
+	one := new(T)
+	if _, err = c.Decode(section, one); err != nil {
+		return nil, true, err
+	}
+	return []*T{one}, true, nil
+}
+
+// Register 注册插件, 需要在Init之前调用, 插件名不能重复
+func (pl *LuaPool) Register(p Plugin) error {
+	pl.m.Lock()
+	defer pl.m.Unlock()
+
+	for _, old := range pl.plugins {
+		if old.Name() == p.Name() {
+			return fmt.Errorf("插件[%s]已注册", p.Name())
+		}
+	}
+	pl.plugins = append(pl.plugins, p)
+	return nil
+}
+
+// initPlugins 所有插件读取配置后检查配置文件, 再按注册顺序初始化
+func (pl *LuaPool) initPlugins() (err error) {
+	for _, p := range pl.plugins {
+		if err = p.Decode(pl.conf.sections); err != nil {
+			return fmt.Errorf("插件[%s]读取配置失败: %w", p.Name(), err)
+		}
+	}
+	if err = pl.conf.Validate(); err != nil {
+		return fmt.Errorf("配置错误: %w", err)
+	}
+	for _, p := range pl.plugins {
+		if err = p.Init(); err != nil {
+			return fmt.Errorf("插件[%s]初始化失败: %w", p.Name(), err)
+		}
+	}
+	return nil
+}
+
+// Health 检查所有插件的状态, 返回所有失败插件的错误
+func (pl *LuaPool) Health(ctx context.Context) error {
+	var errs []error
+	for _, p := range pl.plugins {
+		if err := p.Health(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("插件[%s]: %w", p.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// notConfigured 插件未配置时在require中抛出错误
+func notConfigured(L *lua.LState, name string) int {
+	L.RaiseError("%s: %v", name, ErrNotConfigured)
+	return 0
+}
+
+// closePlugins 关闭所有插件的连接和缓存
+func (pl *LuaPool) closePlugins() {
+	for _, p := range pl.plugins {
+		if err := p.Close(); err != nil {
+			pl.logger.Warn("关闭插件[%s]失败: %v", p.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package luavm
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// echoPlugin 测试用插件, 返回配置中的Prefix
+type echoPlugin struct {
+	conf struct {
+		Prefix string
+	}
+	inited bool
+	closed bool
+	health error
+}
+
+func (p *echoPlugin) Name() string { return "echo" }
+
+func (p *echoPlugin) Decode(conf *PluginConfig) error {
+	_, err := conf.Decode("Echo", &p.conf)
+	return err
+}
+
+func (p *echoPlugin) Init() error {
+	p.inited = true
+	return nil
+}
+
+func (p *echoPlugin) Loader(L *lua.LState) int {
+	mod := L.NewTable()
+	mod.RawSetString("say", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(p.conf.Prefix + L.CheckString(1)))
+		return 1
+	}))
+	L.Push(mod)
+	return 1
+}
+
+func (p *echoPlugin) Health(ctx context.Context) error { return p.health }
+
+func (p *echoPlugin) Close() error {
+	p.closed = true
+	return nil
+}
+
+func TestPluginRegister(t *testing.T) {
+	//未配置的内置插件不初始化
+	pool := NewLuaPool()
+	echo := new(echoPlugin)
+	if err := pool.Register(echo); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Register(new(echoPlugin)); err == nil {
+		t.Fatal("重复注册插件未报错")
+	}
+	if err := pool.InitFromConf("[Echo]\nPrefix = \"hello \""); err != nil {
+		t.Fatal(err)
+	}
+	if !echo.inited {
+		t.Fatal("插件未初始化")
+	}
+
+	vm := pool.Get()
+	errNo, _, err := vm.DoString(`return require("echo").say("easy")`)
+	pool.Put(vm)
+	if err != nil || errNo != "hello easy" {
+		t.Fatalf("插件返回不符[%s] %v", errNo, err)
+	}
+	for _, name := range []string{"mysql", "redis", "mongodb"} {
+		vm = pool.Get()
+		_, _, err = vm.DoString(`require("` + name + `")`)
+		pool.Put(vm)
+		if err == nil || !strings.Contains(err.Error(), ErrNotConfigured.Error()) {
+			t.Fatalf("未配置的插件[%s]可以加载 %v", name, err)
+		}
+	}
+
+	echo.health = errors.New("down")
+	if err := pool.Health(context.Background()); !errors.Is(err, echo.health) {
+		t.Fatalf("健康检查结果不符 %v", err)
+	}
+	if err := pool.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !echo.closed {
+		t.Fatal("Shutdown未关闭插件")
+	}
+}
@@ -1,6 +1,7 @@
 package luavm
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -8,21 +9,72 @@ import (
 	lua "github.com/yuin/gopher-lua"
 )
 
+//defaultInstance 模块函数使用的实例名, 配置为[Redis]/[Mongodb]时实例名为default
+const defaultInstance = "default"
+
+//redisConfig 配置文件中的[Redis]或[[Redis]]
+type redisConfig struct {
+	Name     string
+	Addr     string
+	Passwd   string
+	DataBase int
+}
+
+//redisInstance 一个redis实例的连接池
+type redisInstance struct {
+	name string
+	pool *redis.Pool
+}
+
 //luaRedis redis插件
+//
+//	[[Redis]]
+//	Name = "cache"
+//	Addr = "127.0.0.1:6379"
+//
+//	local redis = require("redis")
+//	local cache = redis.connect("cache")
+//	cache.get("key")
+//	redis.get("key") --使用default实例
 type luaRedis struct {
-	pool *redis.Pool
+	confs     []*redisConfig
+	instances map[string]*redisInstance
 }
 
-//newLuaRedis 这里会初始化redis连接池
+//newLuaRedis ...
 func newLuaRedis() *luaRedis {
 	r := new(luaRedis)
-
+	r.instances = make(map[string]*redisInstance, 4)
 	return r
 }
 
-//Init 初始化redis插件
-func (r *luaRedis) Init(addr, passwd string, database int) (err error) {
-	r.pool = &redis.Pool{
+//Name 插件名
+func (r *luaRedis) Name() string { return "redis" }
+
+//Decode 读取配置文件中的[Redis]或[[Redis]]
+func (r *luaRedis) Decode(conf *PluginConfig) (err error) {
+	r.confs, _, err = decodeInstances[redisConfig](conf, "Redis")
+	return
+}
+
+//Init 初始化redis插件, 为每个实例创建连接池
+func (r *luaRedis) Init() (err error) {
+	for _, c := range r.confs {
+		name := c.Name
+		if name == "" {
+			name = defaultInstance
+		}
+		if _, ok := r.instances[name]; ok {
+			return fmt.Errorf("redis实例[%s]重复", name)
+		}
+		r.instances[name] = &redisInstance{name: name, pool: newRedisPool(c)}
+	}
+	return nil
+}
+
+func newRedisPool(c *redisConfig) *redis.Pool {
+	addr, passwd, database := c.Addr, c.Passwd, c.DataBase
+	return &redis.Pool{
 		MaxIdle:     100,
 		IdleTimeout: 240 * time.Second,
 		Dial: func() (redis.Conn, error) {
@@ -45,24 +97,104 @@ func (r *luaRedis) Init(addr, passwd string, database int) (err error) {
 			return err
 		},
 	}
+}
+
+//Close 关闭所有redis连接池
+func (r *luaRedis) Close() (err error) {
+	for _, inst := range r.instances {
+		if e := inst.pool.Close(); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+//Health 检查所有redis实例
+func (r *luaRedis) Health(ctx context.Context) error {
+	for name, inst := range r.instances {
+		conn, err := inst.pool.GetContext(ctx)
+		if err != nil {
+			return fmt.Errorf("redis实例[%s]: %v", name, err)
+		}
+		_, err = conn.Do("PING")
+		conn.Close()
+		if err != nil {
+			return fmt.Errorf("redis实例[%s]: %v", name, err)
+		}
+	}
 	return nil
 }
 
-//Loader ...
+//getConn 按脚本的context获取连接, 脚本执行超时后不再等待连接
+func (c *redisInstance) getConn(L *lua.LState) (redis.Conn, error) {
+	return c.pool.GetContext(luaContext(L))
+}
+
+//do 执行redis命令, 脚本的context设置了截止时间时作为命令超时时间
+func do(L *lua.LState, conn redis.Conn, cmd string, args ...interface{}) (interface{}, error) {
+	ctx := luaContext(L)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		return redis.DoWithTimeout(conn, time.Until(deadline), cmd, args...)
+	}
+	return conn.Do(cmd, args...)
+}
+
+//redisCommands lua中可以调用的redis命令
+var redisCommands = map[string]func(*redisInstance, *lua.LState) int{
+	"get":  (*redisInstance).get,
+	"set":  (*redisInstance).set,
+	"del":  (*redisInstance).del,
+	"hget": (*redisInstance).hget,
+	"hset": (*redisInstance).hset,
+	"hdel": (*redisInstance).hdel,
+}
+
+//Loader 模块函数使用default实例, connect获取其他实例
 func (r *luaRedis) Loader(L *lua.LState) int {
-	var exports = map[string]lua.LGFunction{
-		"get":  r.get,
-		"set":  r.set,
-		"del":  r.del,
-		"hget": r.hget,
-		"hset": r.hset,
-		"hdel": r.hdel,
-	}
-	mod := L.SetFuncs(L.NewTable(), exports)
+	if len(r.instances) == 0 {
+		return notConfigured(L, "redis")
+	}
+	mod := L.NewTable()
+	mod.RawSetString("connect", L.NewFunction(r.connect))
+	for name, cmd := range redisCommands {
+		cmd := cmd
+		mod.RawSetString(name, L.NewFunction(func(L *lua.LState) int {
+			inst := r.instances[defaultInstance]
+			if inst == nil {
+				L.RaiseError("redis实例[%s]不存在", defaultInstance)
+			}
+			return cmd(inst, L)
+		}))
+	}
 	L.Push(mod)
 	return 1
 }
 
+//connect 获取指定名称的redis实例, 返回的对象可以使用 . 或 : 调用命令
+func (r *luaRedis) connect(L *lua.LState) int {
+	name := L.CheckString(1)
+	inst := r.instances[name]
+	if inst == nil {
+		pushTwoErr(fmt.Errorf("redis实例[%s]不存在", name), L)
+		return 2
+	}
+	handle := L.NewTable()
+	for name, cmd := range redisCommands {
+		cmd := cmd
+		handle.RawSetString(name, L.NewFunction(func(L *lua.LState) int {
+			if L.Get(1) == handle {
+				L.Remove(1)
+			}
+			return cmd(inst, L)
+		}))
+	}
+	L.Push(handle)
+	return 1
+}
+
 func getNumArgs(num int, L *lua.LState) (args []interface{}, err error) {
 	if L.GetTop() != num {
 		err = fmt.Errorf("参数个数不匹配[%d]-[%d]", num, L.GetTop())
@@ -90,8 +222,12 @@ func pushTwoErr(err error, L *lua.LState) {
 	return
 }
 
-func (r *luaRedis) get(L *lua.LState) int {
-	conn := r.pool.Get()
+func (c *redisInstance) get(L *lua.LState) int {
+	conn, err := c.getConn(L)
+	if err != nil {
+		pushTwoErr(err, L)
+		return 2
+	}
 	defer conn.Close()
 
 	args, err := getNumArgs(1, L)
@@ -99,7 +235,7 @@ func (r *luaRedis) get(L *lua.LState) int {
 		pushTwoErr(err, L)
 		return 2
 	}
-	ret, err := redis.String(conn.Do("get", args[0]))
+	ret, err := redis.String(do(L, conn, "get", args[0]))
 	if err != nil {
 		pushTwoErr(err, L)
 		return 2
@@ -108,8 +244,12 @@ func (r *luaRedis) get(L *lua.LState) int {
 	return 1
 }
 
-func (r *luaRedis) set(L *lua.LState) int {
-	conn := r.pool.Get()
+func (c *redisInstance) set(L *lua.LState) int {
+	conn, err := c.getConn(L)
+	if err != nil {
+		pushErr(err, L)
+		return 1
+	}
 	defer conn.Close()
 
 	args, err := getNumArgs(2, L)
@@ -117,7 +257,7 @@ func (r *luaRedis) set(L *lua.LState) int {
 		pushErr(err, L)
 		return 1
 	}
-	_, err = conn.Do("set", args[0], args[1])
+	_, err = do(L, conn, "set", args[0], args[1])
 	if err != nil {
 		pushErr(err, L)
 		return 1
@@ -125,8 +265,12 @@ func (r *luaRedis) set(L *lua.LState) int {
 	return 0
 }
 
-func (r *luaRedis) del(L *lua.LState) int {
-	conn := r.pool.Get()
+func (c *redisInstance) del(L *lua.LState) int {
+	conn, err := c.getConn(L)
+	if err != nil {
+		pushErr(err, L)
+		return 1
+	}
 	defer conn.Close()
 
 	args, err := getNumArgs(1, L)
@@ -134,7 +278,7 @@ func (r *luaRedis) del(L *lua.LState) int {
 		pushErr(err, L)
 		return 1
 	}
-	_, err = conn.Do("del", args[0])
+	_, err = do(L, conn, "del", args[0])
 	if err != nil {
 		pushErr(err, L)
 		return 1
@@ -142,8 +286,12 @@ func (r *luaRedis) del(L *lua.LState) int {
 	return 0
 }
 
-func (r *luaRedis) hget(L *lua.LState) int {
-	conn := r.pool.Get()
+func (c *redisInstance) hget(L *lua.LState) int {
+	conn, err := c.getConn(L)
+	if err != nil {
+		pushTwoErr(err, L)
+		return 2
+	}
 	defer conn.Close()
 
 	args, err := getNumArgs(2, L)
@@ -151,7 +299,7 @@ func (r *luaRedis) hget(L *lua.LState) int {
 		pushTwoErr(err, L)
 		return 2
 	}
-	ret, err := redis.String(conn.Do("hget", args[0], args[1]))
+	ret, err := redis.String(do(L, conn, "hget", args[0], args[1]))
 	if err != nil {
 		pushTwoErr(err, L)
 		return 2
@@ -160,8 +308,12 @@ func (r *luaRedis) hget(L *lua.LState) int {
 	return 1
 }
 
-func (r *luaRedis) hset(L *lua.LState) int {
-	conn := r.pool.Get()
+func (c *redisInstance) hset(L *lua.LState) int {
+	conn, err := c.getConn(L)
+	if err != nil {
+		pushErr(err, L)
+		return 1
+	}
 	defer conn.Close()
 
 	args, err := getNumArgs(3, L)
@@ -169,7 +321,7 @@ func (r *luaRedis) hset(L *lua.LState) int {
 		pushErr(err, L)
 		return 1
 	}
-	_, err = conn.Do("hset", args[0], args[1], args[2])
+	_, err = do(L, conn, "hset", args[0], args[1], args[2])
 	if err != nil {
 		pushErr(err, L)
 		return 1
@@ -177,8 +329,12 @@ func (r *luaRedis) hset(L *lua.LState) int {
 	return 0
 }
 
-func (r *luaRedis) hdel(L *lua.LState) int {
-	conn := r.pool.Get()
+func (c *redisInstance) hdel(L *lua.LState) int {
+	conn, err := c.getConn(L)
+	if err != nil {
+		pushErr(err, L)
+		return 1
+	}
 	defer conn.Close()
 
 	args, err := getNumArgs(2, L)
@@ -186,7 +342,7 @@ func (r *luaRedis) hdel(L *lua.LState) int {
 		pushErr(err, L)
 		return 1
 	}
-	_, err = conn.Do("hdel", args[0], args[1])
+	_, err = do(L, conn, "hdel", args[0], args[1])
 	if err != nil {
 		pushErr(err, L)
 		return 1
@@ -10,7 +10,8 @@ func TestLuaRedis(t *testing.T) {
 	defer pool.Put(vm)
 
 	redis := newLuaRedis()
-	if err := redis.Init("192.168.1.30:6379", "easy", 0); err != nil {
+	redis.confs = []*redisConfig{{Addr: "192.168.1.30:6379", Passwd: "easy", DataBase: 0}}
+	if err := redis.Init(); err != nil {
 		t.Fatal(err)
 	}
 	vm.PreLoadModule("redis", redis.Loader)
@@ -65,7 +66,8 @@ func BenchmarkRedis(b *testing.B) {
 		pool := NewLuaPool()
 
 		redis := newLuaRedis()
-		if err := redis.Init("192.168.1.30:6379", "easy", 0); err != nil {
+		redis.confs = []*redisConfig{{Addr: "192.168.1.30:6379", Passwd: "easy", DataBase: 0}}
+		if err := redis.Init(); err != nil {
 			b.Fatal(err)
 		}
 
@@ -96,3 +98,51 @@ func BenchmarkRedis(b *testing.B) {
 
 	})
 }
+
+func TestRedisInstances(t *testing.T) {
+	//[Redis]视为default实例
+	pool := NewLuaPool()
+	if err := pool.InitFromConf("[Redis]\nAddr = \"127.0.0.1:6379\""); err != nil {
+		t.Fatal(err)
+	}
+	vm := pool.Get()
+	script := `
+		local redis = require("redis")
+		assert(redis.connect("default"))
+		assert(type(redis.get) == "function")
+	`
+	if _, _, err := vm.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(vm)
+
+	pool = NewLuaPool()
+	conf := `
+[[Redis]]
+Name = "cache"
+Addr = "127.0.0.1:6379"
+
+[[Redis]]
+Name = "session"
+Addr = "127.0.0.1:6380"
+DataBase = 1
+`
+	if err := pool.InitFromConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	vm = pool.Get()
+	defer pool.Put(vm)
+	script = `
+		local redis = require("redis")
+		local cache = redis.connect("cache")
+		assert(type(cache.get) == "function" and type(cache.hset) == "function")
+		assert(redis.connect("session"))
+		local none, err = redis.connect("none")
+		assert(none == nil and err ~= nil)
+		--没有default实例时模块函数报错
+		assert(not pcall(redis.get, "key"))
+	`
+	if _, _, err := vm.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,171 @@
+package luavm
+
+import (
+	"context"
+	"fmt"
+
+	"luavm/internal/number"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Result 脚本执行结果
+type Result struct {
+	ErrNo  string //第一个返回值
+	ErrMsg string //第二个返回值
+	//Raw 第三个返回值, 没有时为easy.response, 虚拟机归还后不应再使用
+	Raw lua.LValue
+
+	data      interface{}
+	dataErr   error
+	converted bool
+}
+
+// ErrNoSuccess 表示成功的errNo, 与空errNo同样视为成功
+const ErrNoSuccess = "0000"
+
+// Success errNo为空或ErrNoSuccess时为true
+func (r *Result) Success() bool {
+	return isSuccess(r.ErrNo)
+}
+
+func isSuccess(errNo string) bool {
+	return errNo == "" || errNo == ErrNoSuccess
+}
+
+// Data Raw转换后的Go类型: table为 map[string]interface{} 或 []interface{},
+// number为float64, int64为int64, decimal为json.Number, sql的null为nil.
+// 第一次调用时才转换, 需要在虚拟机归还前调用. 无法转换(如table存在循环引用)时
+// 返回错误, 不影响脚本本身的执行结果
+func (r *Result) Data() (interface{}, error) {
+	if !r.converted {
+		r.data, r.dataErr = toGoValue(r.Raw, nil)
+		if r.dataErr != nil {
+			r.dataErr = fmt.Errorf("转换返回数据失败: %v", r.dataErr)
+		}
+		r.converted = true
+	}
+	return r.data, r.dataErr
+}
+
+// Execute 根据busi和trancode运行lua文件并返回结构化的结果,
+// ctx的处理同DoFileContext
+//
+//	-- busi/trancode/main.lua
+//	return "0000", "成功", {name = "easy"}
+func (l *LuaVM) Execute(ctx context.Context, busi, trancode string) (res *Result, err error) {
+	err = l.runContext(ctx, func() error {
+		res, err = l.doFile(busi, trancode)
+		return err
+	})
+	return
+}
+
+// ExecuteString 同Execute, 执行一个lua字符串, 返回值同时保留在栈上
+func (l *LuaVM) ExecuteString(ctx context.Context, str string) (res *Result, err error) {
+	err = l.runContext(ctx, func() error {
+		res, err = l.doString(str)
+		return err
+	})
+	return
+}
+
+// result 读取脚本执行后栈上base之后的返回值
+func (l *LuaVM) result(base int) *Result {
+	res := new(Result)
+	num := l.l.GetTop() - base
+	//没有返回值默认为成功
+	if num >= 1 {
+		res.ErrNo = l.l.ToString(base + 1)
+	}
+	if num >= 2 {
+		res.ErrMsg = l.l.ToString(base + 2)
+	}
+	if num >= 3 {
+		res.Raw = l.l.Get(base + 3)
+	} else {
+		res.Raw = l.easy.RawGetString("response")
+	}
+	return res
+}
+
+// toGoValue 将lua值转换为Go类型, 连续整数下标的table转换为切片,
+// 其他table转换为以字符串为key的map. 函数、协程等无法转换的值为nil,
+// 作为map的值时忽略该字段
+func toGoValue(lv lua.LValue, visited map[*lua.LTable]bool) (interface{}, error) {
+	switch v := lv.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LString:
+		return string(v), nil
+	case lua.LNumber:
+		return float64(v), nil
+	case *lua.LUserData:
+		if v == sqlNull {
+			return nil, nil
+		}
+		if n, ok := number.ToGo(v); ok {
+			return n, nil
+		}
+		return v.Value, nil
+	case *lua.LTable:
+		if visited == nil {
+			visited = make(map[*lua.LTable]bool, 8)
+		}
+		if visited[v] {
+			return nil, fmt.Errorf("table存在循环引用")
+		}
+		visited[v] = true
+		defer delete(visited, v)
+		return tableToGo(v, visited)
+	default:
+		return nil, nil
+	}
+}
+
+// convertible 函数、协程等无法转换为Go类型的值返回false
+func convertible(lv lua.LValue) bool {
+	switch lv.Type() {
+	case lua.LTFunction, lua.LTThread, lua.LTChannel:
+		return false
+	}
+	return true
+}
+
+func tableToGo(tb *lua.LTable, visited map[*lua.LTable]bool) (interface{}, error) {
+	var err error
+	if n := tb.MaxN(); n > 0 && n == tableLen(tb) {
+		arr := make([]interface{}, n)
+		for i := 1; i <= n; i++ {
+			if arr[i-1], err = toGoValue(tb.RawGetInt(i), visited); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	}
+	m := make(map[string]interface{}, tb.Len())
+	tb.ForEach(func(k, v lua.LValue) {
+		if err != nil || !convertible(v) {
+			return
+		}
+		var val interface{}
+		if val, err = toGoValue(v, visited); err != nil {
+			err = fmt.Errorf("%s: %v", k.String(), err)
+			return
+		}
+		m[k.String()] = val
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// tableLen table中的字段数量
+func tableLen(tb *lua.LTable) int {
+	n := 0
+	tb.ForEach(func(lua.LValue, lua.LValue) { n++ })
+	return n
+}
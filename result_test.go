@@ -0,0 +1,100 @@
+package luavm
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestExecuteResult(t *testing.T) {
+	root := t.TempDir()
+	writeScripts(t, root, map[string]string{
+		"busi/ret/main.lua":   `return "0000", "成功", {name = "easy", list = {1, 2, 3}, ok = true}`,
+		"busi/resp/main.lua":  `easy.response = {"a", "b"}; return "0001", "失败"`,
+		"busi/none/main.lua":  `local a = 1`,
+		"busi/cycle/main.lua": `local t = {}; t.self = t; return "0000", "", t`,
+		"busi/fn/main.lua":    `return "0000", "", {name = "easy", handler = function() end}`,
+	})
+	busi := "busi"
+
+	pool := NewLuaPool()
+	pool.SetFS(os.DirFS(root))
+	vm := pool.Get()
+	defer pool.Put(vm)
+	//easy在归还时清理, 每次执行使用新取出的虚拟机, 归还前转换返回数据
+	execute := func(trancode string) (*Result, interface{}, error) {
+		vm := pool.Get()
+		defer pool.Put(vm)
+		res, err := vm.Execute(context.Background(), busi, trancode)
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := res.Data()
+		return res, data, err
+	}
+
+	res, err := vm.Execute(context.Background(), busi, "ret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"name": "easy",
+		"list": []interface{}{1.0, 2.0, 3.0},
+		"ok":   true,
+	}
+	data, err := res.Data()
+	if err != nil || res.ErrNo != "0000" || res.ErrMsg != "成功" || !reflect.DeepEqual(data, want) {
+		t.Fatalf("返回结果不符 %+v", res)
+	}
+	if vm.GetField(res.Raw, "name").String() != "easy" {
+		t.Fatal("Raw返回值不符")
+	}
+	if top := vm.l.GetTop(); top != 0 {
+		t.Fatalf("返回值未从栈上移除[%d]", top)
+	}
+
+	//没有第三个返回值时使用easy.response
+	if res, data, err = execute("resp"); err != nil {
+		t.Fatal(err)
+	}
+	if res.ErrNo != "0001" || !reflect.DeepEqual(data, []interface{}{"a", "b"}) {
+		t.Fatalf("easy.response结果不符 %+v", res)
+	}
+
+	if res, data, err = execute("none"); err != nil {
+		t.Fatal(err)
+	}
+	if res.ErrNo != "" || data != nil {
+		t.Fatalf("无返回值结果不符 %+v", res)
+	}
+
+	//循环引用不影响执行结果, 只在转换数据时报错
+	vm3 := pool.Get()
+	res, err = vm3.Execute(context.Background(), busi, "cycle")
+	if err != nil || res.ErrNo != "0000" {
+		t.Fatalf("循环引用导致执行失败 %+v %v", res, err)
+	}
+	if _, err = res.Data(); err == nil {
+		t.Fatal("循环引用未报错")
+	}
+	pool.Put(vm3)
+
+	//函数不能转换, 忽略而不报错
+	if res, data, err = execute("fn"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(data, map[string]interface{}{"name": "easy"}) {
+		t.Fatalf("函数返回值结果不符 %+v", res)
+	}
+
+	//DoString使用相同的结果处理
+	vm2 := pool.Get()
+	defer pool.Put(vm2)
+	if res, err = vm2.ExecuteString(context.Background(), `return "0002", "失败", {1, print}`); err != nil {
+		t.Fatal(err)
+	}
+	if data, err = res.Data(); err != nil || res.ErrNo != "0002" || !reflect.DeepEqual(data, []interface{}{1.0, nil}) {
+		t.Fatalf("ExecuteString结果不符 %+v", res)
+	}
+}
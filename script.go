@@ -0,0 +1,193 @@
+package luavm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// osFS 直接按操作系统路径打开文件, 未设置脚本根目录时使用,
+// 与按进程工作目录加载脚本的行为一致
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+// scriptEntry 一个已编译的脚本, 文件内容变化时重新编译
+type scriptEntry struct {
+	proto *lua.FunctionProto
+	sum   [sha256.Size]byte
+}
+
+// scriptCache 编译后的lua脚本缓存, 由虚拟机池内所有虚拟机共享,
+// FunctionProto编译后只读, 可以在多个LState之间共享
+type scriptCache struct {
+	lock   sync.RWMutex
+	fsys   fs.FS
+	protos map[string]*scriptEntry
+}
+
+func newScriptCache(fsys fs.FS) *scriptCache {
+	c := new(scriptCache)
+	c.fsys = fsys
+	c.protos = make(map[string]*scriptEntry, 64)
+	return c
+}
+
+// load 获取文件编译后的结果, 文件内容未变化时直接返回缓存.
+// 每次都读取文件并比较内容的哈希, 不依赖修改时间, 修改时间精度内的修改
+// 和embed.FS等没有修改时间的文件系统同样可以正确失效
+func (c *scriptCache) load(name string) (*lua.FunctionProto, error) {
+	key := path.Clean(name)
+	data, err := fs.ReadFile(c.fsys, key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	c.lock.RLock()
+	e := c.protos[key]
+	c.lock.RUnlock()
+	if e != nil && e.sum == sum {
+		return e.proto, nil
+	}
+
+	proto, err := compile(data, key)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	c.protos[key] = &scriptEntry{proto: proto, sum: sum}
+	c.lock.Unlock()
+	return proto, nil
+}
+
+// compileFile 读取并编译一个lua文件
+func compileFile(fsys fs.FS, name string) (*lua.FunctionProto, error) {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	return compile(data, name)
+}
+
+func compile(data []byte, name string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(bytes.NewReader(data), name)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, name)
+}
+
+// loaderLua 替换package.loaders中的文件加载器,
+// 按package.path在脚本根目录中查找模块, 使require的模块也使用编译缓存
+func (l *LuaVM) loaderLua(L *lua.LState) int {
+	name := L.CheckString(1)
+	fp, msg := l.findModule(L, name)
+	if fp == "" {
+		L.Push(lua.LString(msg))
+		return 1
+	}
+	fn, err := l.loadFile(fp)
+	if err != nil {
+		L.RaiseError(err.Error())
+	}
+	L.Push(fn)
+	return 1
+}
+
+// findModule 在package.path中查找模块文件,
+// DoFile执行期间只允许加载当前业务目录下的文件
+func (l *LuaVM) findModule(L *lua.LState, name string) (fp, msg string) {
+	parts := strings.Split(name, ".")
+	for _, p := range parts {
+		if p == "" || strings.ContainsAny(p, `/\`) {
+			return "", fmt.Sprintf("\n\t模块名[%s]不合法", name)
+		}
+	}
+	name = strings.Join(parts, "/")
+	lv := L.GetField(L.GetField(L.Get(lua.EnvironIndex), "package"), "path")
+	pattern, ok := lv.(lua.LString)
+	if !ok {
+		L.RaiseError("package.path must be a string")
+	}
+	var messages []string
+	for _, p := range strings.Split(string(pattern), ";") {
+		fp := path.Clean(strings.Replace(p, "?", name, -1))
+		if l.busi != "" && !inDir(l.busi, fp) {
+			messages = append(messages, fmt.Sprintf("%s 不在业务目录[%s]中", fp, l.busi))
+			continue
+		}
+		if _, err := fs.Stat(l.fsys, fp); err != nil {
+			messages = append(messages, err.Error())
+			continue
+		}
+		return fp, ""
+	}
+	return "", "\n\t" + strings.Join(messages, "\n\t")
+}
+
+// inDir name是否为dir目录下的文件, 两者均为斜杠分隔的路径
+func inDir(dir, name string) bool {
+	dir = path.Clean(dir)
+	if dir == "." {
+		return name != ".." && !strings.HasPrefix(name, "../") && !path.IsAbs(name)
+	}
+	return strings.HasPrefix(name, dir+"/")
+}
+
+// openScript 从脚本根目录加载文件, DoFile执行期间只允许加载当前业务目录下的文件
+func (l *LuaVM) openScript(name string) (*lua.LFunction, error) {
+	fp := path.Clean(name)
+	if l.busi != "" && !inDir(l.busi, fp) {
+		return nil, fmt.Errorf("%s 不在业务目录[%s]中", fp, l.busi)
+	}
+	return l.loadFile(fp)
+}
+
+// loadfileFS 替换基本库的loadfile, 不支持从标准输入加载
+func (l *LuaVM) loadfileFS(L *lua.LState) int {
+	fn, err := l.openScript(L.CheckString(1))
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(fn)
+	return 1
+}
+
+// dofileFS 替换基本库的dofile, 返回文件的全部返回值
+func (l *LuaVM) dofileFS(L *lua.LState) int {
+	fn, err := l.openScript(L.CheckString(1))
+	if err != nil {
+		L.RaiseError(err.Error())
+	}
+	top := L.GetTop()
+	L.Push(fn)
+	L.Call(0, lua.MultRet)
+	return L.GetTop() - top
+}
+
+// installLoader 使用loaderLua替换默认的lua文件加载器,
+// 基本库的dofile、loadfile同样改为从脚本根目录加载, 不能绕过业务目录的限制
+func (l *LuaVM) installLoader() {
+	for name, fn := range map[string]lua.LGFunction{"dofile": l.dofileFS, "loadfile": l.loadfileFS} {
+		if l.l.GetGlobal(name) != lua.LNil {
+			l.l.SetGlobal(name, l.l.NewFunction(fn))
+		}
+	}
+	loaders, ok := l.l.GetField(l.l.GetGlobal("package"), "loaders").(*lua.LTable)
+	if !ok {
+		return
+	}
+	loaders.RawSetInt(2, l.l.NewFunction(l.loaderLua))
+}
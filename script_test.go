@@ -0,0 +1,140 @@
+package luavm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// writeScripts 在root目录中写入脚本, files的键为斜杠分隔的相对路径,
+// root一般为t.TempDir()
+func writeScripts(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, script := range files {
+		fp := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fp, []byte(script), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestScriptCache(t *testing.T) {
+	root := t.TempDir()
+	writeScripts(t, root, map[string]string{"busi/t1/main.lua": `easy.result = 1`})
+
+	pool := NewLuaPool()
+	pool.SetFS(os.DirFS(root))
+	run := func(want lua.LNumber) {
+		vm := pool.Get()
+		defer pool.Put(vm)
+		if err := vm.DoFile("busi", "t1"); err != nil {
+			t.Fatal(err)
+		}
+		if ret := vm.GetEasyAttr("result"); ret != want {
+			t.Fatalf("脚本返回不符[%v]", ret)
+		}
+	}
+
+	//两个虚拟机共享同一个编译结果
+	run(1)
+	vm1 := pool.Get()
+	run(1)
+	pool.Put(vm1)
+	if n := len(pool.scripts.protos); n != 1 {
+		t.Fatalf("编译缓存数量不符[%d]", n)
+	}
+	proto := pool.scripts.protos["busi/t1/main.lua"].proto
+
+	//文件修改后重新编译
+	writeScripts(t, root, map[string]string{"busi/t1/main.lua": `easy.result = 22`})
+	run(22)
+	if pool.scripts.protos["busi/t1/main.lua"].proto == proto {
+		t.Fatal("文件修改后未重新编译")
+	}
+
+	//大小和修改时间都不变的修改同样重新编译
+	file := filepath.Join(root, "busi", "t1", "main.lua")
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeScripts(t, root, map[string]string{"busi/t1/main.lua": `easy.result = 33`})
+	if err = os.Chtimes(file, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	run(33)
+
+	//没有修改时间的文件系统, 如embed.FS
+	fsys := fstest.MapFS{"busi/t1/main.lua": {Data: []byte(`easy.result = 4`)}}
+	pool = NewLuaPool()
+	pool.SetFS(fsys)
+	run(4)
+	fsys["busi/t1/main.lua"].Data = []byte(`easy.result = 5`)
+	run(5)
+}
+
+func TestScriptFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"app/util.lua":     {Data: []byte(`return {value = 7}`)},
+		"app/t1/main.lua":  {Data: []byte(`easy.result = require("util").value`)},
+		"app/t2/main.lua":  {Data: []byte(`require("..other.secret")`)},
+		"app/t3/main.lua":  {Data: []byte(`package.path = "other/?.lua"; require("secret")`)},
+		"other/secret.lua": {Data: []byte(`return {}`)},
+		"app/t4/main.lua":  {Data: []byte(`dofile("other/secret.lua")`)},
+		"app/t5/main.lua":  {Data: []byte(`assert(loadfile("other/secret.lua"))`)},
+		"app/t6/main.lua":  {Data: []byte(`easy.result = dofile("app/util.lua").value`)},
+		"app2/util.lua":    {Data: []byte(`return {value = 8}`)},
+		"app2/t1/main.lua": {Data: []byte(`easy.result = require("util").value`)},
+	}
+	for _, disable := range []bool{false, true} {
+		pool := NewLuaPool()
+		pool.DisableScriptCache = disable
+		pool.SetFS(fsys)
+
+		vm := pool.Get()
+		if err := vm.DoFile("app", "t1"); err != nil {
+			t.Fatal(err)
+		}
+		if ret := vm.GetEasyAttr("result"); ret != lua.LNumber(7) {
+			t.Fatalf("脚本返回不符[%v]", ret)
+		}
+		pool.Put(vm)
+
+		//dofile同样从脚本根目录加载
+		vm = pool.Get()
+		if err := vm.DoFile("app", "t6"); err != nil {
+			t.Fatal(err)
+		}
+		if ret := vm.GetEasyAttr("result"); ret != lua.LNumber(7) {
+			t.Fatalf("dofile返回不符[%v]", ret)
+		}
+		pool.Put(vm)
+
+		//同名模块在另一个业务目录中是不同的文件
+		vm = pool.Get()
+		if err := vm.DoFile("app2", "t1"); err != nil {
+			t.Fatal(err)
+		}
+		if ret := vm.GetEasyAttr("result"); ret != lua.LNumber(8) {
+			t.Fatalf("加载了其他业务目录的模块[%v]", ret)
+		}
+		pool.Put(vm)
+
+		//require、dofile、loadfile不能加载业务目录之外的文件
+		for _, trancode := range []string{"t2", "t3", "t4", "t5"} {
+			vm = pool.Get()
+			err := vm.DoFile("app", trancode)
+			pool.Put(vm)
+			if err == nil || !strings.Contains(err.Error(), "secret") {
+				t.Fatalf("%s 加载了业务目录之外的模块 %v", trancode, err)
+			}
+		}
+	}
+}
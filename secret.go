@@ -0,0 +1,194 @@
+package luavm
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// SecretProvider 解析配置文件中的 ${ref} 引用, 按添加顺序查找, 最后查找环境变量.
+// ${file:/path} 形式的引用直接读取文件, 不经过SecretProvider
+type SecretProvider interface {
+	// Lookup 返回ref对应的值, 没有此引用时ok为false
+	Lookup(ref string) (value string, ok bool, err error)
+}
+
+// envProvider 从环境变量中查找
+type envProvider struct{}
+
+func (envProvider) Lookup(ref string) (string, bool, error) {
+	v, ok := os.LookupEnv(ref)
+	return v, ok, nil
+}
+
+// AddSecretProvider 添加配置文件引用的解析方式, 需要在Init之前调用
+func (pl *LuaPool) AddSecretProvider(p SecretProvider) {
+	pl.conf.providers = append(pl.conf.providers, p)
+}
+
+// checkRefs 检查配置中字符串值里的 ${ref} 引用是否都可以解析, ${file:/path} 读取文件内容,
+// $${ 表示字面量 ${. 配置原文不做修改, 注释、格式和值的类型保持不变,
+// 各段在Decode时由expandFields展开
+func (l *luaConfig) checkRefs(conf string) error {
+	if !strings.Contains(conf, "${") {
+		return nil
+	}
+	var doc map[string]interface{}
+	if _, err := toml.Decode(conf, &doc); err != nil {
+		return err
+	}
+	return l.checkValue(doc, "")
+}
+
+// checkValue 递归检查v中的字符串, key为配置项路径, 用于错误信息
+func (l *luaConfig) checkValue(v interface{}, key string) error {
+	switch x := v.(type) {
+	case string:
+		_, err := l.expandString(x, key)
+		return err
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			sub := k
+			if key != "" {
+				sub = key + "." + k
+			}
+			if err := l.checkValue(x[k], sub); err != nil {
+				return err
+			}
+		}
+	case []map[string]interface{}:
+		for i, m := range x {
+			if err := l.checkValue(m, fmt.Sprintf("%s[%d]", key, i)); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, e := range x {
+			if err := l.checkValue(e, fmt.Sprintf("%s[%d]", key, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expandFields 展开v中所有可以设置的字符串, 包括结构体字段、切片和map中的值
+func (l *luaConfig) expandFields(v reflect.Value, key string) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return l.expandFields(v.Elem(), key)
+		}
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		//interface中的值不能直接修改, 复制后展开再放回
+		e := reflect.New(v.Elem().Type()).Elem()
+		e.Set(v.Elem())
+		if err := l.expandFields(e, key); err != nil {
+			return err
+		}
+		if v.CanSet() {
+			v.Set(e)
+		}
+	case reflect.String:
+		if !v.CanSet() {
+			return nil
+		}
+		r, err := l.expandString(v.String(), key)
+		if err != nil {
+			return err
+		}
+		v.SetString(r)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Field(i); f.CanSet() {
+				if err := l.expandFields(f, key+"."+v.Type().Field(i).Name); err != nil {
+					return err
+				}
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := l.expandFields(v.Index(i), fmt.Sprintf("%s[%d]", key, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			e := reflect.New(iter.Value().Type()).Elem()
+			e.Set(iter.Value())
+			if err := l.expandFields(e, fmt.Sprintf("%s.%v", key, iter.Key())); err != nil {
+				return err
+			}
+			v.SetMapIndex(iter.Key(), e)
+		}
+	}
+	return nil
+}
+
+// expandString 展开一个字符串值
+func (l *luaConfig) expandString(s, key string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		//$${ 为转义
+		if i > 0 && s[i-1] == '$' {
+			b.WriteString(s[:i-1])
+			b.WriteString("${")
+			s = s[i+2:]
+			continue
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			return "", fmt.Errorf("配置[%s]引用缺少 }", key)
+		}
+		ref := s[i+2 : i+j]
+		v, err := l.lookupSecret(ref)
+		if err != nil {
+			return "", fmt.Errorf("配置[%s]: %v", key, err)
+		}
+		b.WriteString(s[:i])
+		b.WriteString(v)
+		s = s[i+j+1:]
+	}
+}
+
+// lookupSecret 解析一个引用, file:前缀的引用读取文件内容并去掉末尾的换行
+func (l *luaConfig) lookupSecret(ref string) (string, error) {
+	if path, ok := strings.CutPrefix(ref, "file:"); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("读取文件失败: %v", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	for _, p := range l.providers {
+		v, ok, err := p.Lookup(ref)
+		if err != nil {
+			return "", fmt.Errorf("解析引用[%s]失败: %v", ref, err)
+		}
+		if ok {
+			return v, nil
+		}
+	}
+	if v, ok, _ := (envProvider{}).Lookup(ref); ok {
+		return v, nil
+	}
+	return "", fmt.Errorf("引用[%s]无法解析", ref)
+}
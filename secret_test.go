@@ -0,0 +1,87 @@
+package luavm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// mapProvider 测试用的密钥查找
+type mapProvider map[string]string
+
+func (m mapProvider) Lookup(ref string) (string, bool, error) {
+	v, ok := m[ref]
+	return v, ok, nil
+}
+
+func TestConfigInterpolate(t *testing.T) {
+	t.Setenv("LUAVM_REDIS_PASSWD", "env-pass")
+	secret := filepath.Join(t.TempDir(), "mongo.pass")
+	if err := os.WriteFile(secret, []byte("file-pass\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf := `
+# 注释中的 ${LUAVM_NOT_EXISTS} 不解析
+[Pool]
+MaxActive = 7
+
+[Redis]
+Addr = "127.0.0.1:6379"
+Passwd = "${LUAVM_REDIS_PASSWD}"
+DB = 2
+
+[Mongodb]
+Addr = "127.0.0.1:27017"
+Passwd = "${file:` + secret + `}"
+
+[[SQL]]
+Name = "main"
+Type = "mysql"
+User = "u-${vault:db/user}"
+Passwd = "$${literal}"
+
+[[SQL]]
+Name = "other"
+Type = "mysql"
+Passwd = "file:/not/exists"
+`
+	c := new(luaConfig)
+	c.providers = []SecretProvider{mapProvider{"vault:db/user": "admin"}}
+	if err := c.LoadFromConf(conf); err != nil {
+		t.Fatal(err)
+	}
+	var redis redisConfig
+	var mongo mgoConfig
+	var sqls []*sqlConfig
+	c.sections.Decode("Redis", &redis)
+	c.sections.Decode("Mongodb", &mongo)
+	c.sections.Decode("SQL", &sqls)
+	if redis.Passwd != "env-pass" || mongo.Passwd != "file-pass" {
+		t.Fatalf("引用展开不符 %q %q", redis.Passwd, mongo.Passwd)
+	}
+	//其他值的类型不变, 解码到map时同样展开
+	var raw map[string]interface{}
+	c.sections.Decode("Redis", &raw)
+	if c.Pool.MaxActive != 7 || raw["DB"] != int64(2) || raw["Passwd"] != "env-pass" {
+		t.Fatalf("配置值不符 %d %#v", c.Pool.MaxActive, raw)
+	}
+	if sqls[0].User != "u-admin" || sqls[0].Passwd != "${literal}" {
+		t.Fatalf("引用展开不符 %q %q", sqls[0].User, sqls[0].Passwd)
+	}
+	//不在${}中的file:前缀按字面量处理
+	if sqls[1].Passwd != "file:/not/exists" {
+		t.Fatalf("字面量被展开 %q", sqls[1].Passwd)
+	}
+
+	//无法解析的引用报错
+	for _, bad := range []string{
+		"[Redis]\nPasswd = \"${LUAVM_NOT_EXISTS}\"",
+		"[Redis]\nPasswd = \"${file:/not/exists}\"",
+	} {
+		err := new(luaConfig).LoadFromConf(bad)
+		if err == nil || !strings.Contains(err.Error(), "Redis.Passwd") {
+			t.Fatalf("无法解析的引用未报错 %v", err)
+		}
+	}
+}
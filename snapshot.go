@@ -0,0 +1,75 @@
+package luavm
+
+import (
+	lua "github.com/yuin/gopher-lua"
+)
+
+// tableSnapshot 一个table在某一时刻的全部字段和元表
+type tableSnapshot struct {
+	fields map[lua.LValue]lua.LValue
+	meta   lua.LValue
+}
+
+// globalSnapshot 虚拟机初始化完成后的全局环境,
+// 归还虚拟机时据此还原, 保证下一次取出的虚拟机和新建的一致.
+// 从_G可以访问到的所有table按引用记录, 不限层数.
+// package.loaded同样还原, 创建后require的模块在归还时移除, 下次require重新加载,
+// 模块内的local变量因此不会带到下一次执行; OnCreate中加载的模块属于初始状态, 一直保留
+type globalSnapshot struct {
+	tables map[*lua.LTable]*tableSnapshot
+}
+
+// snapshot 记录当前的全局环境, 应在加载库之后调用
+func (l *LuaVM) snapshot() {
+	s := &globalSnapshot{
+		tables: make(map[*lua.LTable]*tableSnapshot, 64),
+	}
+	s.save(l.l, l.l.G.Global)
+	l.snap = s
+}
+
+// save 记录tb及其字段中尚未记录的table, 已记录的table保持原有的快照
+func (s *globalSnapshot) save(L *lua.LState, tb *lua.LTable) {
+	pending := []*lua.LTable{tb}
+	for len(pending) > 0 {
+		tb := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if _, ok := s.tables[tb]; ok {
+			continue
+		}
+		ts := &tableSnapshot{
+			fields: make(map[lua.LValue]lua.LValue, tb.Len()),
+			meta:   L.GetMetatable(tb),
+		}
+		s.tables[tb] = ts
+		tb.ForEach(func(k, v lua.LValue) {
+			ts.fields[k] = v
+			if child, ok := v.(*lua.LTable); ok {
+				pending = append(pending, child)
+			}
+		})
+	}
+}
+
+// restore 删除脚本新增的字段, 还原被修改的字段和元表
+func (s *globalSnapshot) restore(L *lua.LState) {
+	for tb, ts := range s.tables {
+		var added []lua.LValue
+		tb.ForEach(func(k, v lua.LValue) {
+			if _, ok := ts.fields[k]; !ok {
+				added = append(added, k)
+			}
+		})
+		for _, k := range added {
+			tb.RawSet(k, lua.LNil)
+		}
+		for k, v := range ts.fields {
+			if tb.RawGet(k) != v {
+				tb.RawSet(k, v)
+			}
+		}
+		if L.GetMetatable(tb) != ts.meta {
+			L.SetMetatable(tb, ts.meta)
+		}
+	}
+}
@@ -1,300 +1,204 @@
 package luavm
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
-	"net/url"
-	"strconv"
+	"math"
 	"sync"
 	"sync/atomic"
 
+	"luavm/internal/number"
+
 	"github.com/yuin/gopher-lua"
 )
 
-//mysql 插件
-type luaMySQL struct {
-	*luaSQL
-}
-
-//mssql 插件
-type luaMsSQL struct {
-	*luaSQL
-}
-
-//sqlite 插件
-type luaSqlite struct {
-	*luaSQL
-}
-
-func newLuaMySQL() *luaMySQL {
-	return &luaMySQL{newLuaSQL()}
-}
-
-func newLuaMsSQL() *luaMsSQL {
-	return &luaMsSQL{newLuaSQL()}
-}
-
-func newLuaSqlite() *luaSqlite {
-	return &luaSqlite{newLuaSQL()}
-}
-
-//luaSQL lua容器sql注入插件,将根据配置初始化多个数据库
+//luaSQL lua容器sql注入插件,每个方言一个实例,将根据配置初始化该类型的多个数据库
 type luaSQL struct {
-	lock  *sync.Mutex
-	db    map[string]*sql.DB
-	cache map[string]*Cache
+	lock    *sync.Mutex
+	sqlType string       //数据库类型, 即方言名
+	d       Dialect      //数据库方言
+	confs   []*sqlConfig //配置文件中的[[SQL]]
+	db      map[string]*sql.DB
+	cache   map[string]*Cache
+	conv    map[string]*columnConverter //查询结果的转换方式
 }
 
-//newLuaSQL ...
-func newLuaSQL() *luaSQL {
+//newLuaSQL 方言须已注册
+func newLuaSQL(sqlType string) *luaSQL {
 	l := new(luaSQL)
 	l.lock = new(sync.Mutex)
+	l.sqlType = sqlType
+	l.d = getDialect(sqlType)
 	l.db = make(map[string]*sql.DB, 10)
 	l.cache = make(map[string]*Cache, 10)
+	l.conv = make(map[string]*columnConverter, 10)
 	return l
 }
 
-//Init 初始化mysql插件
-func (l *luaMySQL) Init(cs []*sqlConfig) (err error) {
-	for _, c := range cs {
-		var db *sql.DB
-		if c.Type == "mysql" {
-			qs, err := url.ParseQuery(c.Params)
-			if err != nil {
-				log.Printf("luaMySQL ParseQuery [%v] error, ERR: %v\n",
-					c.Params, err.Error())
-				qs = url.Values{}
-			}
-			if qs.Get("charset") == "" {
-				qs.Add("charset", "utf8")
-			}
-			if qs.Get("multiStatements") == "" {
-				qs.Add("multiStatements", "true")
-			}
+//Name 插件名
+func (l *luaSQL) Name() string { return l.sqlType }
 
-			myUrl := fmt.Sprintf("%s:%s@tcp(%s)/%s?%s",
-				c.User, c.Passwd, c.Addr, c.DataBase, qs.Encode())
+//Decode 读取配置文件中的[[SQL]]
+func (l *luaSQL) Decode(conf *PluginConfig) (err error) {
+	_, err = conf.Decode("SQL", &l.confs)
+	return
+}
 
-			db, err = sql.Open("mysql", myUrl)
-			if err != nil {
-				log.Printf("luaMySQL Open MSDB [%v] error, ERR: %v\n",
-					qs.Encode(), err.Error())
-				return err
-			}
+//configured 配置文件中是否有该类型的数据库
+func (l *luaSQL) configured(sqlType string) bool {
+	for _, c := range l.confs {
+		if c.Type == sqlType {
+			return true
 		}
-		l.db[c.Name] = db
-		l.cache[c.Name] = NewCache(db)
 	}
-	return nil
+	return false
 }
 
-//Init 初始化mssql插件
-func (l *luaMsSQL) Init(cs []*sqlConfig) (err error) {
-	for _, c := range cs {
-		var db *sql.DB
-		if c.Type == "mssql" {
-			qs, err := url.ParseQuery(c.Params)
-			if err != nil {
-				log.Printf("luaMsSQL ParseQuery [%v] error, ERR: %v\n",
-					c.Params, err.Error())
-				qs = url.Values{}
-			}
-			if qs.Get("connection+timeout") == "" {
-				qs.Add("connection+timeout", "30")
-			}
-			if qs.Get("encrypt") == "" {
-				qs.Add("encrypt", "disable")
-			}
-			if qs.Get("database") == "" {
-				qs.Add("database", c.DataBase)
-			}
+//Health 检查所有数据库连接
+func (l *luaSQL) Health(ctx context.Context) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
 
-			msUrl := &url.URL{
-				Scheme:   "sqlserver",
-				User:     url.UserPassword(c.User, c.Passwd),
-				Host:     c.Addr,
-				RawQuery: qs.Encode(),
-			}
-			db, err = sql.Open("mssql", msUrl.String())
-			if err != nil {
-				log.Printf("luaMsSQL Open MSDB [%v] error, ERR: %v\n",
-					qs.Encode(), err.Error())
-				return err
-			}
+	for name, db := range l.db {
+		if db == nil {
+			continue
+		}
+		if err := db.PingContext(ctx); err != nil {
+			return fmt.Errorf("数据库[%s]: %v", name, err)
 		}
-		l.db[c.Name] = db
-		l.cache[c.Name] = NewCache(db)
 	}
 	return nil
 }
 
-//Init 初始化mssql插件
-func (l *luaSqlite) Init(cs []*sqlConfig) (err error) {
-	for _, c := range cs {
-		var db *sql.DB
-		if c.Type == "sqlite" {
-			db, err = sql.Open("sqlite3", c.Addr)
-			if err != nil {
-				log.Printf("luaSqlite Open MSDB [%v] error, ERR: %v\n",
-					c.Addr, err.Error())
-				return err
-			}
+//Init 初始化配置文件中该类型的数据库
+func (l *luaSQL) Init() (err error) {
+	for _, c := range l.confs {
+		if c.Type != l.sqlType {
+			continue
+		}
+		dsn, err := l.d.DSN(DSNConfig{
+			Name:     c.Name,
+			Addr:     c.Addr,
+			User:     c.User,
+			Passwd:   c.Passwd,
+			DataBase: c.DataBase,
+			Params:   c.Params,
+		})
+		if err != nil {
+			return fmt.Errorf("数据库[%s]: %v", c.Name, err)
+		}
+		db, err := sql.Open(l.d.Driver(), dsn)
+		if err != nil {
+			log.Printf("luaSQL Open [%v] error, ERR: %v\n",
+				c.Name, err.Error())
+			return err
+		}
+		if err = c.setup(db); err != nil {
+			return err
 		}
+		conv := newColumnConverter(l.d, c)
+		cache := NewCache(db)
+		cache.conv = conv
 		l.db[c.Name] = db
-		l.cache[c.Name] = NewCache(db)
+		l.cache[c.Name] = cache
+		l.conv[c.Name] = conv
 	}
 	return nil
 }
 
-//Loader ...
-func (l *luaMySQL) Loader(L *lua.LState) int {
-	var exports = map[string]lua.LGFunction{
-		"connect": l.connect,
+//setup 设置连接池参数, 配置了Ping时检查连接, 失败时关闭db
+func (c *sqlConfig) setup(db *sql.DB) error {
+	if c.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(c.MaxOpenConns)
 	}
-	mod := L.SetFuncs(L.NewTable(), exports)
-	L.Push(mod)
-	return 1
-}
-
-func (l *luaMySQL) connect(L *lua.LState) int {
-	name := L.CheckString(1)
-	//先查找name,如果没有查找sqltype-name
-	db := l.db[name]
-	if db == nil {
-		db = l.db["mysql-"+name]
-		if db == nil {
-			pushTwoErr(fmt.Errorf("数据库[%s]不存在", name), L)
-			return 2
-		}
+	if c.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(c.MaxIdleConns)
 	}
-	cache := l.cache[name]
-	if cache == nil {
-		cache = l.cache["mysql-"+name]
-		if cache == nil {
-			pushTwoErr(fmt.Errorf("缓存[%s]不存在", name), L)
-			return 2
-		}
+	if c.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(c.ConnMaxLifetime)
 	}
-	m := newSQLState(db, "mysql", cache)
-	my := L.NewTable()
-	my.RawSetString("query", L.NewFunction(m.query))
-	my.RawSetString("queryRow", L.NewFunction(m.queryrow))
-	my.RawSetString("queryCache", L.NewFunction(m.queryCache))
-	my.RawSetString("exec", L.NewFunction(m.exec))
-	my.RawSetString("begin", L.NewFunction(m.begin))
-	my.RawSetString("commit", L.NewFunction(m.commit))
-	my.RawSetString("rollback", L.NewFunction(m.rollback))
-	my.RawSetString("logger", L.NewFunction(m.logger))
-	my.RawSetString("insert", L.NewFunction(m.sqlInsert))
-	my.RawSetString("select", L.NewFunction(m.sqlSelect))
-	my.RawSetString("fmtInsert", L.NewFunction(m.fmtInsert))
-	my.RawSetString("fmtSelect", L.NewFunction(m.fmtSelect))
-	my.RawSetString("fmtUpdate", L.NewFunction(m.fmtUpate))
-	my.RawSetString("fmtSql", L.NewFunction(m.fmtSQL))
-	//添加sql事务状态
-	ctx := L.Context()
-	//注册数据库连接状态
-	if addFunc, ok := ctx.Value("addTran").(func(*sqlState)); ok {
-		addFunc(m)
+	if c.ConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(c.ConnMaxIdleTime)
 	}
-	//初始化日志接口
-	if logger, ok := ctx.Value(loggerInterface).(Logger); ok {
-		m.SetLogger(logger)
+	if !c.Ping {
+		return nil
 	}
-	L.Push(my)
-	return 1
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return fmt.Errorf("数据库[%s]连接失败: %v", c.Name, err)
+	}
+	return nil
 }
 
-//Loader ...
-func (l *luaMsSQL) Loader(L *lua.LState) int {
-	var exports = map[string]lua.LGFunction{
-		"connect": l.connect,
+//dbStats 所有数据库连接池的统计数据
+func (l *luaSQL) dbStats() map[string]sql.DBStats {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	st := make(map[string]sql.DBStats, len(l.db))
+	for name, db := range l.db {
+		st[name] = db.Stats()
 	}
-	mod := L.SetFuncs(L.NewTable(), exports)
-	L.Push(mod)
-	return 1
+	return st
 }
 
-func (l *luaMsSQL) connect(L *lua.LState) int {
-	name := L.CheckString(1)
-	//先查找name,如果没有查找sqltype-name
-	db := l.db[name]
-	if db == nil {
-		db = l.db["mssql-"+name]
+//Close 关闭所有数据库连接和缓存
+func (l *luaSQL) Close() (err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for name, db := range l.db {
 		if db == nil {
-			pushTwoErr(fmt.Errorf("数据库[%s]不存在", name), L)
-			return 2
+			continue
 		}
-	}
-	cache := l.cache[name]
-	if cache == nil {
-		cache = l.cache["mssql-"+name]
-		if cache == nil {
-			pushTwoErr(fmt.Errorf("缓存[%s]不存在", name), L)
-			return 2
+		if e := db.Close(); e != nil {
+			log.Printf("luaSQL Close [%v] error, ERR: %v\n", name, e.Error())
+			err = e
 		}
 	}
-	m := newSQLState(db, "mssql", cache)
-	my := L.NewTable()
-	my.RawSetString("query", L.NewFunction(m.query))
-	my.RawSetString("queryRow", L.NewFunction(m.queryrow))
-	my.RawSetString("queryCache", L.NewFunction(m.queryCache))
-	my.RawSetString("exec", L.NewFunction(m.exec))
-	my.RawSetString("begin", L.NewFunction(m.begin))
-	my.RawSetString("commit", L.NewFunction(m.commit))
-	my.RawSetString("rollback", L.NewFunction(m.rollback))
-	my.RawSetString("logger", L.NewFunction(m.logger))
-	my.RawSetString("insert", L.NewFunction(m.sqlInsert))
-	my.RawSetString("select", L.NewFunction(m.sqlSelect))
-	my.RawSetString("fmtInsert", L.NewFunction(m.fmtInsert))
-	my.RawSetString("fmtSelect", L.NewFunction(m.fmtSelect))
-	my.RawSetString("fmtUpdate", L.NewFunction(m.fmtUpate))
-	my.RawSetString("fmtSql", L.NewFunction(m.fmtSQL))
-	//添加sql事务状态
-	ctx := L.Context()
-	//注册数据库连接状态
-	if addFunc, ok := ctx.Value("addTran").(func(*sqlState)); ok {
-		addFunc(m)
-	}
-	//初始化日志接口
-	if logger, ok := ctx.Value(loggerInterface).(Logger); ok {
-		m.SetLogger(logger)
+	for _, cache := range l.cache {
+		cache.Destory()
 	}
-	L.Push(my)
-	return 1
+	l.db = make(map[string]*sql.DB)
+	l.cache = make(map[string]*Cache)
+	return
 }
 
 //Loader ...
-func (l *luaSqlite) Loader(L *lua.LState) int {
+func (l *luaSQL) Loader(L *lua.LState) int {
+	if !l.configured(l.sqlType) {
+		return notConfigured(L, l.sqlType)
+	}
 	var exports = map[string]lua.LGFunction{
 		"connect": l.connect,
 	}
 	mod := L.SetFuncs(L.NewTable(), exports)
+	mod.RawSetString("null", sqlNull)
 	L.Push(mod)
 	return 1
 }
 
-func (l *luaSqlite) connect(L *lua.LState) int {
+func (l *luaSQL) connect(L *lua.LState) int {
 	name := L.CheckString(1)
 	//先查找name,如果没有查找sqltype-name
 	db := l.db[name]
 	if db == nil {
-		db = l.db["sqlite-"+name]
+		name = l.sqlType + "-" + name
+		db = l.db[name]
 		if db == nil {
-			pushTwoErr(fmt.Errorf("数据库[%s]不存在", name), L)
+			pushTwoErr(fmt.Errorf("数据库[%s]不存在", L.CheckString(1)), L)
 			return 2
 		}
 	}
 	cache := l.cache[name]
 	if cache == nil {
-		cache = l.cache["sqlite-"+name]
-		if cache == nil {
-			pushTwoErr(fmt.Errorf("缓存[%s]不存在", name), L)
-			return 2
-		}
+		pushTwoErr(fmt.Errorf("缓存[%s]不存在", name), L)
+		return 2
 	}
-	m := newSQLState(db, "sqlite", cache)
+	m := newSQLState(db, l.sqlType, cache)
+	m.conv = l.conv[name]
 	my := L.NewTable()
 	my.RawSetString("query", L.NewFunction(m.query))
 	my.RawSetString("queryRow", L.NewFunction(m.queryrow))
@@ -310,10 +214,11 @@ func (l *luaSqlite) connect(L *lua.LState) int {
 	my.RawSetString("fmtSelect", L.NewFunction(m.fmtSelect))
 	my.RawSetString("fmtUpdate", L.NewFunction(m.fmtUpate))
 	my.RawSetString("fmtSql", L.NewFunction(m.fmtSQL))
+	my.RawSetString("fmtLimit", L.NewFunction(m.fmtLimit))
 	//添加sql事务状态
-	ctx := L.Context()
+	ctx := luaContext(L)
 	//注册数据库连接状态
-	if addFunc, ok := ctx.Value("addTran").(func(*sqlState)); ok {
+	if addFunc, ok := ctx.Value(tranfunc("addTran")).(func(*sqlState)); ok {
 		addFunc(m)
 	}
 	//初始化日志接口
@@ -328,6 +233,8 @@ func (l *luaSqlite) connect(L *lua.LState) int {
 type sqlState struct {
 	status  int32  //记录事务状态
 	sqlType string //数据库类型
+	d       Dialect      //数据库方言
+	conv    *columnConverter
 	db      *sql.DB
 	tx      *sql.Tx
 	l       Logger
@@ -338,6 +245,8 @@ func newSQLState(db *sql.DB, sqlType string, cache *Cache) *sqlState {
 	m := new(sqlState)
 	m.db = db
 	m.sqlType = sqlType
+	m.d = getDialect(sqlType)
+	m.conv = newColumnConverter(m.d, nil)
 	m.cache = cache
 	return m
 }
@@ -347,7 +256,8 @@ func (my *sqlState) SetLogger(l Logger) {
 	my.l = l
 }
 
-//GetArgs 获取诸如(cmd string, a ...interface{})形式的参数
+//GetArgs 获取诸如(cmd string, a ...interface{})形式的参数,
+//整数为int64, 其他数值为float64, int64、decimal原样传给驱动, null为NULL
 func GetArgs(L *lua.LState) (cmd string, args []interface{}, err error) {
 	num := L.GetTop()
 	if num < 1 {
@@ -363,7 +273,22 @@ func GetArgs(L *lua.LState) (cmd string, args []interface{}, err error) {
 			case lua.LTString:
 				args[i-2] = arg.String()
 			case lua.LTNumber:
-				a, _ := strconv.Atoi(arg.String())
+				f := float64(arg.(lua.LNumber))
+				if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+					args[i-2] = int64(f)
+				} else {
+					args[i-2] = f
+				}
+			case lua.LTUserData:
+				if arg == sqlNull {
+					args[i-2] = nil
+					continue
+				}
+				a, ok := number.ToGo(arg)
+				if !ok {
+					err = fmt.Errorf("参数类型错误[%d]", i)
+					return
+				}
 				args[i-2] = a
 			default:
 				err = fmt.Errorf("参数类型错误[%d]", i)
@@ -377,7 +302,7 @@ func GetArgs(L *lua.LState) (cmd string, args []interface{}, err error) {
 //插入sql日志表专用,不走事务,直接返回错误
 func (my *sqlState) logger(L *lua.LState) int {
 	str := L.CheckString(1)
-	_, err := my.db.Exec(str)
+	_, err := my.db.ExecContext(luaContext(L), str)
 	if err != nil {
 		if l := len(str); l > 0 && str[l-1] == '\n' {
 			my.l.Error("  <%s> logger error: %v\n  <sql->\n%s  <-sql>\n", my.sqlType, err.Error(), str)
@@ -398,7 +323,7 @@ func (my *sqlState) queryCache(L *lua.LState) int {
 	key := L.CheckString(1)
 	cmd := L.CheckString(2)
 	expire := L.CheckInt(3)
-	value, err := my.cache.QueryCache(key, cmd, expire)
+	value, err := my.cache.QueryCacheContext(luaContext(L), key, cmd, expire)
 	if err != nil {
 		pushTwoErr(err, L)
 		return 2
@@ -413,7 +338,8 @@ func (my *sqlState) query(L *lua.LState) int {
 		pushTwoErr(err, L)
 		return 2
 	}
-	rows, err := my.db.Query(cmd, args...)
+	cmd = rebind(my.d, cmd)
+	rows, err := my.db.QueryContext(luaContext(L), cmd, args...)
 	if err != nil {
 		pushTwoErr(err, L)
 		return 2
@@ -437,29 +363,19 @@ func (my *sqlState) query(L *lua.LState) int {
 	//lua 数组下标从1开始
 	index := 1
 	for rows.Next() {
-		if err = rows.Scan(m...); err != nil {
+		if err = scanRow(rows, m, values); err != nil {
 			pushTwoErr(err, L)
 			return 2
 		}
 		table := L.NewTable()
-		for i := range values {
-			fmt.Printf("query: %v[%v]\n", i, cols[i].DatabaseTypeName())
-			switch cols[i].DatabaseTypeName() {
-			case "INT", "INTEGER", "BIGINT", "FLOAT", "DOUBLE", "REAL":
-				val, err := strconv.ParseFloat(string(values[i]), 64)
-				if err != nil {
-					pushTwoErr(err, L)
-					return 2
-				}
-				L.SetField(table, cols[i].Name(), lua.LNumber(val))
-			default:
-				L.SetField(table, cols[i].Name(), lua.LString(string(values[i])))
-			}
+		if err = my.conv.row(table, cols, values); err != nil {
+			pushTwoErr(err, L)
+			return 2
 		}
 		L.RawSetInt(all, index, table)
 		index++
 	}
-	if rows.Err() != nil {
+	if err = rows.Err(); err != nil {
 		pushTwoErr(err, L)
 		return 2
 	}
@@ -473,7 +389,8 @@ func (my *sqlState) queryrow(L *lua.LState) int {
 		pushTwoErr(err, L)
 		return 2
 	}
-	rows, err := my.db.Query(cmd, args...)
+	cmd = rebind(my.d, cmd)
+	rows, err := my.db.QueryContext(luaContext(L), cmd, args...)
 	if err != nil {
 		pushTwoErr(err, L)
 		return 2
@@ -502,23 +419,13 @@ func (my *sqlState) queryrow(L *lua.LState) int {
 		pushTwoErr(fmt.Errorf("sql: no rows in result set"), L)
 		return 2
 	}
-	if err := rows.Scan(m...); err != nil {
+	if err := scanRow(rows, m, values); err != nil {
 		pushTwoErr(err, L)
 		return 2
 	}
-	for i := range values {
-		fmt.Printf("queryrow: %v[%v]\n", i, cols[i].DatabaseTypeName())
-		switch cols[i].DatabaseTypeName() {
-		case "INT", "INTEGER", "BIGINT", "FLOAT", "DOUBLE", "REAL":
-			val, err := strconv.ParseFloat(string(values[i]), 64)
-			if err != nil {
-				pushTwoErr(err, L)
-				return 2
-			}
-			L.SetField(table, cols[i].Name(), lua.LNumber(val))
-		default:
-			L.SetField(table, cols[i].Name(), lua.LString(string(values[i])))
-		}
+	if err := my.conv.row(table, cols, values); err != nil {
+		pushTwoErr(err, L)
+		return 2
 	}
 	L.Push(table)
 	return 1
@@ -535,7 +442,8 @@ func (my *sqlState) exec(L *lua.LState) int {
 		pushTwoErr(err, L)
 		return 2
 	}
-	result, err := my.tx.Exec(cmd, args...)
+	cmd = rebind(my.d, cmd)
+	result, err := my.tx.ExecContext(luaContext(L), cmd, args...)
 	if err != nil {
 		pushTwoErr(err, L)
 		return 2
@@ -543,27 +451,29 @@ func (my *sqlState) exec(L *lua.LState) int {
 	t := L.NewTable()
 	lastInsertID, err := result.LastInsertId()
 	if err == nil {
-		L.SetField(t, "insertid", lua.LNumber(float64(lastInsertID)))
+		L.SetField(t, "insertid", number.FromInt64(lastInsertID))
 	}
 	affectRow, err := result.RowsAffected()
 	if err == nil {
-		L.SetField(t, "affected", lua.LNumber(float64(affectRow)))
+		L.SetField(t, "affected", number.FromInt64(affectRow))
 	}
 	L.Push(t)
 	return 1
 }
 
+//开始事务失败时不改变事务状态, 返回错误信息
 func (my *sqlState) begin(L *lua.LState) int {
-	if !atomic.CompareAndSwapInt32(&my.status, 0, 1) {
+	if atomic.LoadInt32(&my.status) != 0 {
 		L.Push(lua.LString("事务已经开始"))
 		return 1
 	}
-	tx, err := my.db.Begin()
+	tx, err := my.db.BeginTx(luaContext(L), nil)
 	if err != nil {
 		L.Push(lua.LString(err.Error()))
 		return 1
 	}
 	my.tx = tx
+	atomic.StoreInt32(&my.status, 1)
 	return 0
 
 }
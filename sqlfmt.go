@@ -3,11 +3,12 @@ package luavm
 import (
 	"database/sql"
 	"fmt"
-	"strconv"
 	"strings"
 	"sync/atomic"
 	"unsafe"
 
+	"luavm/internal/number"
+
 	"github.com/yuin/gopher-lua"
 )
 
@@ -18,37 +19,15 @@ const (
 	MSSQL = "mssql"
 	//SQLITE ...
 	SQLITE = "sqlite"
+	//POSTGRES ...
+	POSTGRES = "postgres"
 )
 
 func toString(b []byte) (s string) {
 	return *(*string)(unsafe.Pointer(&b))
 }
 
-func quote(sqlType, name string) string {
-	switch sqlType {
-	case MYSQL:
-		return "`" + name + "`"
-	case MSSQL:
-		return "[" + name + "]"
-	case SQLITE:
-		return "`" + name + "`"
-	}
-	return ""
-}
-
-func quoteByte(sqlType string) byte {
-	switch sqlType {
-	case MYSQL:
-		return '\\'
-	case MSSQL:
-		return '\''
-	case SQLITE:
-		return '\\'
-	}
-	return ' '
-}
-
-func isText(sqlType, s string) (bool, string) {
+func isText(d Dialect, s string) (bool, string) {
 	l := len(s)
 	if l == 0 {
 		return true, "'"
@@ -69,19 +48,8 @@ func isText(sqlType, s string) (bool, string) {
 		if start == '\'' || end == '\'' {
 			return true, ""
 		}
-		switch sqlType {
-		case MSSQL:
-			if start == '[' || end == ']' {
-				return false, ""
-			}
-		case MYSQL:
-			if start == '`' || end == '`' {
-				return false, ""
-			}
-		case SQLITE:
-			if start == '`' || end == '`' {
-				return false, ""
-			}
+		if q := d.Quote(""); len(q) > 1 && (start == q[0] || end == q[len(q)-1]) {
+			return false, ""
 		}
 		break
 	}
@@ -103,11 +71,11 @@ func isText(sqlType, s string) (bool, string) {
 
 }
 
-func fmtTxt(sqlType, txt string) string {
+//escapeQuote 使用qu转义字符串中的单引号, 已转义的不再处理
+func escapeQuote(qu byte, txt string) string {
 	var last byte
 	var pos int
 	var has = false
-	var qu = quoteByte(sqlType)
 	for pos = range txt {
 		cur := txt[pos]
 		if cur == '\'' {
@@ -143,7 +111,7 @@ func fmtTxt(sqlType, txt string) string {
 	return toString(tmp)
 }
 
-func getArgs(sqlType string, L *lua.LState, top int) (args []interface{}, err error) {
+func getArgs(d Dialect, L *lua.LState, top int) (args []interface{}, err error) {
 
 	num := L.GetTop()
 	if num <= top {
@@ -159,8 +127,15 @@ func getArgs(sqlType string, L *lua.LState, top int) (args []interface{}, err er
 			args[i-top] = L.ToBool(i + 1)
 		case lua.LTNumber:
 			args[i-top] = L.ToNumber(i + 1)
+		case lua.LTUserData:
+			s, ok := number.String(arg)
+			if !ok {
+				err = fmt.Errorf("参数类型错误[%d]", i+1)
+				return
+			}
+			args[i-top] = s
 		case lua.LTString:
-			args[i-top] = fmtTxt(sqlType, L.ToString(i+1))
+			args[i-top] = d.Escape(L.ToString(i + 1))
 		default:
 			err = fmt.Errorf("参数类型错误[%d]", i+1)
 			return
@@ -169,7 +144,7 @@ func getArgs(sqlType string, L *lua.LState, top int) (args []interface{}, err er
 	return
 }
 
-func getCmdArgs(sqlType string, L *lua.LState) (cmd string, args []interface{}, err error) {
+func getCmdArgs(d Dialect, L *lua.LState) (cmd string, args []interface{}, err error) {
 	num := L.GetTop()
 	if num < 1 {
 		err = fmt.Errorf("参数个数错误[%d]", num)
@@ -187,8 +162,15 @@ func getCmdArgs(sqlType string, L *lua.LState) (cmd string, args []interface{},
 				args[i-2] = L.ToBool(i)
 			case lua.LTNumber:
 				args[i-2] = L.ToNumber(i)
+			case lua.LTUserData:
+				s, ok := number.String(arg)
+				if !ok {
+					err = fmt.Errorf("参数类型错误[%d]", i)
+					return
+				}
+				args[i-2] = s
 			case lua.LTString:
-				args[i-2] = fmtTxt(sqlType, L.ToString(i))
+				args[i-2] = d.Escape(L.ToString(i))
 			default:
 				err = fmt.Errorf("参数类型错误[%d]", i)
 				return
@@ -198,16 +180,117 @@ func getCmdArgs(sqlType string, L *lua.LState) (cmd string, args []interface{},
 	return
 }
 
-func toBool(b lua.LBool) int {
-	if b {
-		return 1
+//rebind 将?占位符转换为方言对应的形式, 如postgres的$1,$2...
+//引号、注释(-- 和 /* */)以及postgres的$$或$tag$字符串内的?不做转换,
+//?? 转换为字面量?, 用于postgres jsonb的 ?、?|、?& 运算符, 如 data ??| array['a']
+func rebind(d Dialect, cmd string) string {
+	if d.Placeholder(1) == "?" || strings.IndexByte(cmd, '?') < 0 {
+		return cmd
+	}
+	var buff strings.Builder
+	var n int
+	for i := 0; i < len(cmd); {
+		c := cmd[i]
+		switch {
+		case c == '\'' || c == '"':
+			//E'...'中的\'为转义
+			escape := c == '\'' && i > 0 && (cmd[i-1] == 'E' || cmd[i-1] == 'e')
+			end := i + 1
+			for end < len(cmd) && cmd[end] != c {
+				if escape && cmd[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end = min(end+1, len(cmd))
+			buff.WriteString(cmd[i:end])
+			i = end
+		case c == '-' && strings.HasPrefix(cmd[i:], "--"):
+			end := strings.IndexByte(cmd[i:], '\n')
+			if end < 0 {
+				end = len(cmd) - i
+			}
+			buff.WriteString(cmd[i : i+end])
+			i += end
+		case c == '/' && strings.HasPrefix(cmd[i:], "/*"):
+			//postgres的块注释可以嵌套
+			end, depth := i+2, 1
+			for end < len(cmd) && depth > 0 {
+				switch {
+				case strings.HasPrefix(cmd[end:], "/*"):
+					depth++
+					end += 2
+				case strings.HasPrefix(cmd[end:], "*/"):
+					depth--
+					end += 2
+				default:
+					end++
+				}
+			}
+			buff.WriteString(cmd[i:end])
+			i = end
+		case c == '$':
+			tag := dollarTag(cmd[i:])
+			if tag == "" {
+				buff.WriteByte(c)
+				i++
+				continue
+			}
+			end := strings.Index(cmd[i+len(tag):], tag)
+			if end < 0 {
+				end = len(cmd)
+			} else {
+				end = i + len(tag) + end + len(tag)
+			}
+			buff.WriteString(cmd[i:end])
+			i = end
+		case c == '?' && strings.HasPrefix(cmd[i:], "??"):
+			buff.WriteByte('?')
+			i += 2
+		case c == '?':
+			n++
+			buff.WriteString(d.Placeholder(n))
+			i++
+		default:
+			buff.WriteByte(c)
+			i++
+		}
+	}
+	return buff.String()
+}
+
+//dollarTag s开头的$$或$tag$, 不是时返回空. $1等占位符不是tag
+func dollarTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '$':
+			return s[:i+1]
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80:
+		case c >= '0' && c <= '9' && i > 1:
+		default:
+			return ""
+		}
+	}
+	return ""
+}
+
+//isFmtValue fmt系列函数支持的值: String、Bool、Number、int64、decimal以及null
+func isFmtValue(value lua.LValue) bool {
+	switch value.Type() {
+	case lua.LTBool, lua.LTNumber, lua.LTString:
+		return true
 	}
-	return 0
+	if value == sqlNull {
+		return true
+	}
+	_, ok := number.String(value)
+	return ok
 }
 
 //不断生成Field集合
-func genInsertField(sqlType string, buff *strings.Builder, index int, key lua.LValue) {
-	keyStr := quote(sqlType, key.String())
+func genInsertField(d Dialect, buff *strings.Builder, index int, key lua.LValue) {
+	keyStr := d.Quote(key.String())
 	if index == 0 {
 		buff.WriteString(fmt.Sprintf("%s", keyStr))
 		return
@@ -217,27 +300,27 @@ func genInsertField(sqlType string, buff *strings.Builder, index int, key lua.LV
 }
 
 //不断生成Value集合
-func genInsertValue(sqlType string, buff *strings.Builder, value lua.LValue) {
+func genInsertValue(d Dialect, buff *strings.Builder, value lua.LValue) {
 	switch value.Type() {
 	case lua.LTBool:
-		switch sqlType {
-		case MSSQL:
-			buff.WriteString(fmt.Sprintf(" %d ", toBool(value.(lua.LBool))))
-			return
-		case MYSQL:
-			buff.WriteString(fmt.Sprintf(" %t ", value.(lua.LBool)))
-			return
-		case SQLITE:
-			buff.WriteString(fmt.Sprintf(" %t ", value.(lua.LBool)))
-		}
+		buff.WriteString(fmt.Sprintf(" %s ", d.Bool(bool(value.(lua.LBool)))))
+		return
 	case lua.LTNumber:
 		buff.WriteString(fmt.Sprintf(" %v ", value.(lua.LNumber)))
 		return
+	case lua.LTUserData:
+		if value == sqlNull {
+			buff.WriteString(" NULL ")
+			return
+		}
+		s, _ := number.String(value)
+		buff.WriteString(fmt.Sprintf(" %s ", s))
+		return
 	case lua.LTString:
 		s := string(value.(lua.LString))
-		if ok, quotes := isText(sqlType, s); ok {
+		if ok, quotes := isText(d, s); ok {
 			if quotes != "" {
-				buff.WriteString(fmt.Sprintf("%s%s%s", quotes, fmtTxt(sqlType, s), quotes))
+				buff.WriteString(fmt.Sprintf("%s%s%s", quotes, d.Escape(s), quotes))
 				return
 			}
 			buff.WriteString(fmt.Sprintf(" %s ", s))
@@ -270,7 +353,7 @@ func (my *sqlState) fmtInsertSQL(L *lua.LState) (str string, err error) {
 
 	//从Table中顺序遍历所有的属性
 	var f, v strings.Builder
-	f.WriteString(fmt.Sprintf("insert into%s(", quote(my.sqlType, table)))
+	f.WriteString(fmt.Sprintf("insert into%s(", my.d.Quote(table)))
 	v.WriteString(" values(")
 	index := 0
 	key, value := fields.Next(lua.LNil)
@@ -279,16 +362,16 @@ func (my *sqlState) fmtInsertSQL(L *lua.LState) (str string, err error) {
 			err = fmt.Errorf("key类型[%s]不为String", key.Type().String())
 			return
 		}
-		genInsertField(my.sqlType, &f, index, key)
+		genInsertField(my.d, &f, index, key)
 
-		if t := value.Type(); t != lua.LTBool && t != lua.LTNumber && t != lua.LTString {
+		if !isFmtValue(value) {
 			err = fmt.Errorf("val类型[%s]不为String或Bool或Number", key.Type().String())
 			return
 		}
 		if index > 0 {
 			v.WriteString(" ,")
 		}
-		genInsertValue(my.sqlType, &v, value)
+		genInsertValue(my.d, &v, value)
 		key, value = fields.Next(key)
 		index++
 	}
@@ -309,7 +392,7 @@ func (my *sqlState) sqlInsert(L *lua.LState) int {
 		pushTwoErr(err, L)
 		return 2
 	}
-	result, err := my.tx.Exec(str)
+	result, err := my.tx.ExecContext(luaContext(L), str)
 	if err != nil {
 		pushTwoErr(err, L)
 		return 2
@@ -317,44 +400,43 @@ func (my *sqlState) sqlInsert(L *lua.LState) int {
 	t := L.NewTable()
 	lastInsertID, err := result.LastInsertId()
 	if err == nil {
-		L.SetField(t, "insertid", lua.LNumber(float64(lastInsertID)))
+		L.SetField(t, "insertid", number.FromInt64(lastInsertID))
 	}
 	affectRow, err := result.RowsAffected()
 	if err == nil {
-		L.SetField(t, "affected", lua.LNumber(float64(affectRow)))
+		L.SetField(t, "affected", number.FromInt64(affectRow))
 	}
 	L.Push(t)
 	return 1
 
 }
 
-func genSelectField(sqlType string, buff *strings.Builder, key, value lua.LValue) {
-	keyStr := quote(sqlType, key.String())
+func genSelectField(d Dialect, buff *strings.Builder, key, value lua.LValue) {
+	keyStr := d.Quote(key.String())
 	switch value.Type() {
 	case lua.LTBool:
-		switch sqlType {
-		case MSSQL:
-			buff.WriteString(fmt.Sprintf(" %d %s", toBool(value.(lua.LBool)), keyStr))
-			return
-		case MYSQL:
-			buff.WriteString(fmt.Sprintf(" %t %s", value.(lua.LBool), keyStr))
-			return
-		case SQLITE:
-			buff.WriteString(fmt.Sprintf(" %t %s", value.(lua.LBool), keyStr))
-			return
-		}
+		buff.WriteString(fmt.Sprintf(" %s %s", d.Bool(bool(value.(lua.LBool))), keyStr))
+		return
 	case lua.LTNumber:
 		buff.WriteString(fmt.Sprintf(" %v %s", value.(lua.LNumber), keyStr))
 		return
+	case lua.LTUserData:
+		if value == sqlNull {
+			buff.WriteString(fmt.Sprintf(" NULL %s", keyStr))
+			return
+		}
+		s, _ := number.String(value)
+		buff.WriteString(fmt.Sprintf(" %s %s", s, keyStr))
+		return
 	case lua.LTString:
 		s := string(value.(lua.LString))
 		if s == "" {
 			buff.WriteString(fmt.Sprintf("%s", keyStr))
 			return
 		}
-		if ok, quotes := isText(sqlType, s); ok {
+		if ok, quotes := isText(d, s); ok {
 			if quotes != "" {
-				buff.WriteString(fmt.Sprintf("%s%s%s %s", quotes, fmtTxt(sqlType, s), quotes, keyStr))
+				buff.WriteString(fmt.Sprintf("%s%s%s %s", quotes, d.Escape(s), quotes, keyStr))
 				return
 			}
 			buff.WriteString(fmt.Sprintf(" %s %s", s, keyStr))
@@ -384,7 +466,7 @@ func (my *sqlState) sqlSelect(L *lua.LState) int {
 		return 2
 	}
 
-	rows, err := my.db.Query(str)
+	rows, err := my.db.QueryContext(luaContext(L), str)
 	if err != nil {
 		pushTwoErr(err, L)
 		return 2
@@ -409,28 +491,19 @@ func (my *sqlState) sqlSelect(L *lua.LState) int {
 	//lua 数组下标从1开始
 	index := 1
 	for rows.Next() {
-		if err = rows.Scan(m...); err != nil {
+		if err = scanRow(rows, m, values); err != nil {
 			pushTwoErr(err, L)
 			return 2
 		}
 		table := L.NewTable()
-		for i := range values {
-			switch cols[i].DatabaseTypeName() {
-			case "INT", "BIGINT", "FLOAT", "DOUBLE":
-				val, err := strconv.ParseFloat(string(values[i]), 64)
-				if err != nil {
-					pushTwoErr(err, L)
-					return 2
-				}
-				L.SetField(table, cols[i].Name(), lua.LNumber(val))
-			default:
-				L.SetField(table, cols[i].Name(), lua.LString(string(values[i])))
-			}
+		if err = my.conv.row(table, cols, values); err != nil {
+			pushTwoErr(err, L)
+			return 2
 		}
 		L.RawSetInt(all, index, table)
 		index++
 	}
-	if rows.Err() != nil {
+	if err = rows.Err(); err != nil {
 		pushTwoErr(err, L)
 		return 2
 	}
@@ -451,7 +524,7 @@ func (my *sqlState) fmtSelectSQL(L *lua.LState) (str string, err error) {
 		where = L.CheckString(3)
 	}
 	if L.GetTop() > 3 {
-		args, err = getArgs(my.sqlType, L, 3)
+		args, err = getArgs(my.d, L, 3)
 	}
 	if err != nil {
 		err = fmt.Errorf("参数不正确%v", err)
@@ -469,19 +542,19 @@ func (my *sqlState) fmtSelectSQL(L *lua.LState) (str string, err error) {
 			return
 		}
 
-		if t := value.Type(); t != lua.LTBool && t != lua.LTNumber && t != lua.LTString {
+		if !isFmtValue(value) {
 			pushTwoErr(fmt.Errorf("val类型[%s]不为String或Bool或Number", key.Type().String()), L)
 			return
 		}
 		if index > 0 {
 			f.WriteString(" ,")
 		}
-		genSelectField(my.sqlType, &f, key, value)
+		genSelectField(my.d, &f, key, value)
 		key, value = fields.Next(key)
 		index++
 	}
 
-	f.WriteString(fmt.Sprintf(" from %s", quote(my.sqlType, table)))
+	f.WriteString(fmt.Sprintf(" from %s", my.d.Quote(table)))
 	if len(where) > 0 {
 		f.WriteString(" where ")
 		f.WriteString(fmt.Sprintf(where, args...))
@@ -489,29 +562,28 @@ func (my *sqlState) fmtSelectSQL(L *lua.LState) (str string, err error) {
 	return f.String(), nil
 }
 
-func genUpdate(sqlType string, buff *strings.Builder, key, value lua.LValue) {
-	keyStr := quote(sqlType, key.String())
+func genUpdate(d Dialect, buff *strings.Builder, key, value lua.LValue) {
+	keyStr := d.Quote(key.String())
 	switch value.Type() {
 	case lua.LTBool:
-		switch sqlType {
-		case MSSQL:
-			buff.WriteString(fmt.Sprintf(" %s = %d ", keyStr, toBool(value.(lua.LBool))))
-			return
-		case MYSQL:
-			buff.WriteString(fmt.Sprintf(" %s = %t ", keyStr, value.(lua.LBool)))
-			return
-		case SQLITE:
-			buff.WriteString(fmt.Sprintf(" %s = %t ", keyStr, value.(lua.LBool)))
-			return
-		}
+		buff.WriteString(fmt.Sprintf(" %s = %s ", keyStr, d.Bool(bool(value.(lua.LBool)))))
+		return
 	case lua.LTNumber:
 		buff.WriteString(fmt.Sprintf(" %s = %v ", keyStr, value.(lua.LNumber)))
 		return
+	case lua.LTUserData:
+		if value == sqlNull {
+			buff.WriteString(fmt.Sprintf(" %s = NULL ", keyStr))
+			return
+		}
+		s, _ := number.String(value)
+		buff.WriteString(fmt.Sprintf(" %s = %s ", keyStr, s))
+		return
 	case lua.LTString:
 		s := string(value.(lua.LString))
-		if ok, quotes := isText(sqlType, s); ok {
+		if ok, quotes := isText(d, s); ok {
 			if quotes != "" {
-				buff.WriteString(fmt.Sprintf(" %s = %s%s%s", keyStr, quotes, fmtTxt(sqlType, s), quotes))
+				buff.WriteString(fmt.Sprintf(" %s = %s%s%s", keyStr, quotes, d.Escape(s), quotes))
 				return
 			}
 			buff.WriteString(fmt.Sprintf(" %s = %s ", keyStr, s))
@@ -542,7 +614,7 @@ func (my *sqlState) fmtUpate(L *lua.LState) int {
 		where = string(any.(lua.LString))
 		var err error
 		if L.GetTop() > 3 {
-			wheArgs, err = getArgs(my.sqlType, L, 3)
+			wheArgs, err = getArgs(my.d, L, 3)
 		}
 		if err != nil {
 			pushTwoErr(fmt.Errorf("参数不正确 %v", err), L)
@@ -558,21 +630,21 @@ func (my *sqlState) fmtUpate(L *lua.LState) int {
 	//从Table中顺序遍历所有的属性, 生成set
 	var f strings.Builder
 	var index = 0
-	f.WriteString(fmt.Sprintf("update %s set ", quote(my.sqlType, table)))
+	f.WriteString(fmt.Sprintf("update %s set ", my.d.Quote(table)))
 	key, value := sets.Next(lua.LNil)
 	for key.Type() != lua.LTNil {
 		if key.Type() != lua.LTString {
 			pushTwoErr(fmt.Errorf("key类型[%s]不为String", key.Type().String()), L)
 			return 2
 		}
-		if t := value.Type(); t != lua.LTBool && t != lua.LTNumber && t != lua.LTString {
+		if !isFmtValue(value) {
 			pushTwoErr(fmt.Errorf("val类型[%s]不为String或Bool或Number", key.Type().String()), L)
 			return 2
 		}
 		if index > 0 {
 			f.WriteString(",")
 		}
-		genUpdate(my.sqlType, &f, key, value)
+		genUpdate(my.d, &f, key, value)
 		key, value = sets.Next(key)
 		index++
 	}
@@ -594,9 +666,14 @@ func (my *sqlState) fmtUpate(L *lua.LState) int {
 				if index > 0 {
 					f.WriteString(" AND ")
 				}
-				genUpdate(my.sqlType, &f, key, value)
+				//条件中的NULL需要用is判断
+				if value == sqlNull {
+					f.WriteString(fmt.Sprintf(" %s is NULL ", my.d.Quote(key.String())))
+				} else {
+					genUpdate(my.d, &f, key, value)
+				}
 
-				if t := value.Type(); t != lua.LTBool && t != lua.LTNumber && t != lua.LTString {
+				if !isFmtValue(value) {
 					pushTwoErr(fmt.Errorf("val类型[%s]不为String或Bool或Number", key.Type().String()), L)
 					return 2
 				}
@@ -610,7 +687,7 @@ func (my *sqlState) fmtUpate(L *lua.LState) int {
 }
 
 func (my *sqlState) fmtSQL(L *lua.LState) int {
-	cmd, args, err := getCmdArgs(my.sqlType, L)
+	cmd, args, err := getCmdArgs(my.d, L)
 	if err != nil {
 		pushTwoErr(fmt.Errorf("参数类型不正确,至少1而不是%d", L.GetTop()), L)
 		return 2
@@ -626,3 +703,11 @@ func (my *sqlState) fmtSQL(L *lua.LState) int {
 	L.Push(lua.LString(buff.String()))
 	return 1
 }
+
+//格式化分页子句, 如 conn.fmtLimit(10, 20)
+func (my *sqlState) fmtLimit(L *lua.LState) int {
+	limit := L.CheckInt(1)
+	offset := L.OptInt(2, 0)
+	L.Push(lua.LString(my.d.Limit(limit, offset)))
+	return 1
+}
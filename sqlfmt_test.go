@@ -3,6 +3,8 @@ package luavm
 import (
 	"testing"
 
+	"github.com/yuin/gopher-lua"
+
 	_ "github.com/go-sql-driver/mysql"
 )
 
@@ -21,8 +23,9 @@ func TestFmtSelect(t *testing.T) {
 			DataBase: "test",
 		},
 	}
-	my := newLuaMySQL()
-	if err := my.Init(conf); err != nil {
+	my := newLuaSQL(MYSQL)
+	my.confs = conf
+	if err := my.Init(); err != nil {
 		t.Fatal(err)
 	}
 	vm.PreLoadModule("mysql", my.Loader)
@@ -47,3 +50,54 @@ func TestFmtSelect(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestPostgresRebind(t *testing.T) {
+	cases := []struct{ in, out string }{
+		{"select * from t where a = ? and b = ?", "select * from t where a = $1 and b = $2"},
+		{"select '?' , \"a?\" from t where a = ?", "select '?' , \"a?\" from t where a = $1"},
+		{"select 'it''s ?' from t where a=?", "select 'it''s ?' from t where a=$1"},
+		{"select 1", "select 1"},
+		{"select 1 -- a?\nfrom t where a = ?", "select 1 -- a?\nfrom t where a = $1"},
+		{"select /* a? /* b? */ c? */ 1 where a = ?", "select /* a? /* b? */ c? */ 1 where a = $1"},
+		{"select $$a?$$, $fn$ b? $$ c? $fn$ where a = ?", "select $$a?$$, $fn$ b? $$ c? $fn$ where a = $1"},
+		{"select E'it\\'s ?' where a = ?", "select E'it\\'s ?' where a = $1"},
+		{"select * from t where data ?? 'a' and data ??| array['b'] and data ??& ? and id = ?",
+			"select * from t where data ? 'a' and data ?| array['b'] and data ?& $1 and id = $2"},
+		{"select a from t where id = ? and b = $1", "select a from t where id = $1 and b = $1"},
+	}
+	for _, c := range cases {
+		if got := rebind(getDialect(POSTGRES), c.in); got != c.out {
+			t.Errorf("rebind(%q) = %q, 期望 %q", c.in, got, c.out)
+		}
+	}
+	if got := rebind(getDialect(MYSQL), cases[0].in); got != cases[0].in {
+		t.Errorf("mysql不应转换占位符 %q", got)
+	}
+}
+
+func TestPostgresFmt(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	m := newSQLState(nil, POSTGRES, nil)
+	L.SetGlobal("fmtInsert", L.NewFunction(m.fmtInsert))
+	L.SetGlobal("fmtSelect", L.NewFunction(m.fmtSelect))
+	L.SetGlobal("fmtUpdate", L.NewFunction(m.fmtUpate))
+
+	cases := []struct{ script, want string }{
+		{`return fmtInsert("user", {name = "it's"})`, `insert into"user"("name") values('it''s')`},
+		{`return fmtInsert("user", {ok = true})`, `insert into"user"("ok") values( TRUE )`},
+		{`return fmtSelect("user", {name = ""}, "id = %v", 1)`, `select "name" from "user" where id = 1`},
+		{`return fmtSelect("user", {ok = false})`, `select  FALSE "ok" from "user"`},
+		{`return fmtUpdate("user", {ok = true}, {id = 1})`, `update "user" set  "ok" = TRUE   where  "id" = 1 `},
+		{`return fmtUpdate("user", {name = '"other"'}, "id = %v", 1)`, `update "user" set  "name" = "other"   where id = 1`},
+	}
+	for _, c := range cases {
+		if err := L.DoString(c.script); err != nil {
+			t.Fatal(err)
+		}
+		if got := L.ToString(-1); got != c.want {
+			t.Errorf("%s\n得到 %q\n期望 %q", c.script, got, c.want)
+		}
+		L.SetTop(0)
+	}
+}
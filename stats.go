@@ -0,0 +1,297 @@
+package luavm
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defBuckets 默认的耗时分布区间,单位秒,与prometheus默认值一致
+var defBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram 耗时分布, Counts[i]为耗时不超过Buckets[i]的次数
+type Histogram struct {
+	Buckets []float64 //区间上限,单位秒
+	Counts  []uint64  //每个区间的累计次数
+	Count   uint64    //总次数
+	Sum     float64   //总耗时,单位秒
+}
+
+func newHistogram() Histogram {
+	return Histogram{
+		Buckets: defBuckets,
+		Counts:  make([]uint64, len(defBuckets)),
+	}
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	for i, b := range h.Buckets {
+		if v <= b {
+			h.Counts[i]++
+		}
+	}
+	h.Count++
+	h.Sum += v
+}
+
+func (h Histogram) clone() Histogram {
+	h.Counts = append([]uint64(nil), h.Counts...)
+	return h
+}
+
+// ExecStats 单个交易的执行统计
+type ExecStats struct {
+	Busi     string
+	Trancode string
+	Duration Histogram //执行耗时分布
+	Failures uint64    //lua运行出错的次数
+}
+
+// PoolStats 虚拟机池统计数据
+type PoolStats struct {
+	Created   uint64                 //累计创建的虚拟机数量
+	Destroyed uint64                 //累计销毁的虚拟机数量
+	Idle      int                    //当前空闲的虚拟机数量
+	InUse     int                    //当前使用中的虚拟机数量
+	Wait      Histogram              //Get等待时间分布
+	Execs     map[string]*ExecStats  //按 busi/trancode 统计的执行情况
+	Errors    map[string]uint64      //按脚本返回的errNo统计的次数,超过maxErrnos种后计入"other",空errNo和"0000"视为成功不统计
+	DB        map[string]sql.DBStats //按[[SQL]]的Name统计的数据库连接池
+}
+
+// dbStatser 提供数据库连接池统计的插件
+type dbStatser interface {
+	dbStats() map[string]sql.DBStats
+}
+
+// poolStats 虚拟机池内部统计, 所有字段由lock保护
+type poolStats struct {
+	lock      sync.Mutex
+	created   uint64
+	destroyed uint64
+	wait      Histogram
+	execs     map[string]*ExecStats
+	errors    map[string]uint64
+}
+
+func newPoolStats() *poolStats {
+	s := new(poolStats)
+	s.wait = newHistogram()
+	s.execs = make(map[string]*ExecStats, 64)
+	s.errors = make(map[string]uint64, 16)
+	return s
+}
+
+func (s *poolStats) addCreated() {
+	s.lock.Lock()
+	s.created++
+	s.lock.Unlock()
+}
+
+func (s *poolStats) addDestroyed() {
+	s.lock.Lock()
+	s.destroyed++
+	s.lock.Unlock()
+}
+
+func (s *poolStats) observeWait(d time.Duration) {
+	s.lock.Lock()
+	s.wait.observe(d)
+	s.lock.Unlock()
+}
+
+// observeExec 记录一次交易执行, busi为空时只统计errNo
+func (s *poolStats) observeExec(busi, trancode string, d time.Duration, errNo string, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !isSuccess(errNo) {
+		if _, ok := s.errors[errNo]; !ok && len(s.errors) >= maxErrnos {
+			errNo = errnoOther
+		}
+		s.errors[errNo]++
+	}
+	if busi == "" {
+		return
+	}
+	key := busi + "/" + trancode
+	e := s.execs[key]
+	if e == nil {
+		e = &ExecStats{Busi: busi, Trancode: trancode, Duration: newHistogram()}
+		s.execs[key] = e
+	}
+	e.Duration.observe(d)
+	if err != nil {
+		e.Failures++
+	}
+}
+
+// maxErrnos 分别统计的errNo的最大数量, 避免驱动或脚本返回的任意错误码产生无限多的统计项,
+// 超出后新出现的errNo计入errnoOther
+const maxErrnos = 128
+
+const errnoOther = "other"
+
+func (s *poolStats) copyTo(st *PoolStats) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st.Created = s.created
+	st.Destroyed = s.destroyed
+	st.Wait = s.wait.clone()
+	st.Execs = make(map[string]*ExecStats, len(s.execs))
+	for k, e := range s.execs {
+		c := *e
+		c.Duration = e.Duration.clone()
+		st.Execs[k] = &c
+	}
+	st.Errors = make(map[string]uint64, len(s.errors))
+	for k, n := range s.errors {
+		st.Errors[k] = n
+	}
+}
+
+// Stats 获取虚拟机池当前的统计数据
+func (pl *LuaPool) Stats() *PoolStats {
+	st := new(PoolStats)
+	pl.stats.copyTo(st)
+
+	st.DB = make(map[string]sql.DBStats)
+	for _, p := range pl.plugins {
+		if ds, ok := p.(dbStatser); ok {
+			for name, s := range ds.dbStats() {
+				st.DB[name] = s
+			}
+		}
+	}
+
+	pl.m.Lock()
+	st.Idle = len(pl.saved)
+	st.InUse = pl.active - len(pl.saved)
+	pl.m.Unlock()
+	return st
+}
+
+// StatsHandler 以prometheus文本格式输出虚拟机池统计数据
+//
+//	http.Handle("/metrics", luaPool.StatsHandler())
+func (pl *LuaPool) StatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := pl.Stats().WritePrometheus(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// WritePrometheus 以prometheus文本格式写出统计数据
+func (st *PoolStats) WritePrometheus(w io.Writer) error {
+	b := bufio.NewWriter(w)
+
+	writeMetric(b, "luavm_pool_created_total", "counter", "Total number of lua VMs created.")
+	fmt.Fprintf(b, "luavm_pool_created_total %d\n", st.Created)
+	writeMetric(b, "luavm_pool_destroyed_total", "counter", "Total number of lua VMs destroyed.")
+	fmt.Fprintf(b, "luavm_pool_destroyed_total %d\n", st.Destroyed)
+	writeMetric(b, "luavm_pool_idle", "gauge", "Number of idle lua VMs.")
+	fmt.Fprintf(b, "luavm_pool_idle %d\n", st.Idle)
+	writeMetric(b, "luavm_pool_in_use", "gauge", "Number of lua VMs in use.")
+	fmt.Fprintf(b, "luavm_pool_in_use %d\n", st.InUse)
+
+	writeMetric(b, "luavm_pool_wait_seconds", "histogram", "Time spent waiting for a lua VM.")
+	writeHistogram(b, "luavm_pool_wait_seconds", "", st.Wait)
+
+	keys := make([]string, 0, len(st.Execs))
+	for k := range st.Execs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	writeMetric(b, "luavm_exec_duration_seconds", "histogram", "Script execution time by busi and trancode.")
+	for _, k := range keys {
+		e := st.Execs[k]
+		labels := fmt.Sprintf(`busi="%s",trancode="%s"`, escapeLabel(e.Busi), escapeLabel(e.Trancode))
+		writeHistogram(b, "luavm_exec_duration_seconds", labels, e.Duration)
+	}
+	writeMetric(b, "luavm_exec_failures_total", "counter", "Script executions that raised a lua error.")
+	for _, k := range keys {
+		e := st.Execs[k]
+		fmt.Fprintf(b, "luavm_exec_failures_total{busi=\"%s\",trancode=\"%s\"} %d\n",
+			escapeLabel(e.Busi), escapeLabel(e.Trancode), e.Failures)
+	}
+
+	keys = keys[:0]
+	for k := range st.Errors {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	writeMetric(b, "luavm_exec_errors_total", "counter", "Script results by returned errNo.")
+	for _, k := range keys {
+		fmt.Fprintf(b, "luavm_exec_errors_total{errno=\"%s\"} %d\n", escapeLabel(k), st.Errors[k])
+	}
+
+	keys = keys[:0]
+	for k := range st.DB {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	dbMetrics := []struct {
+		name, typ, help string
+		value           func(sql.DBStats) float64
+	}{
+		{"luavm_sql_max_open_connections", "gauge", "Maximum number of open connections to the database.",
+			func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }},
+		{"luavm_sql_open_connections", "gauge", "Number of established connections to the database.",
+			func(s sql.DBStats) float64 { return float64(s.OpenConnections) }},
+		{"luavm_sql_in_use_connections", "gauge", "Number of connections currently in use.",
+			func(s sql.DBStats) float64 { return float64(s.InUse) }},
+		{"luavm_sql_idle_connections", "gauge", "Number of idle connections.",
+			func(s sql.DBStats) float64 { return float64(s.Idle) }},
+		{"luavm_sql_wait_count_total", "counter", "Total number of connections waited for.",
+			func(s sql.DBStats) float64 { return float64(s.WaitCount) }},
+		{"luavm_sql_wait_duration_seconds_total", "counter", "Total time blocked waiting for a new connection.",
+			func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }},
+		{"luavm_sql_max_lifetime_closed_total", "counter", "Total number of connections closed due to ConnMaxLifetime.",
+			func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) }},
+		{"luavm_sql_max_idle_time_closed_total", "counter", "Total number of connections closed due to ConnMaxIdleTime.",
+			func(s sql.DBStats) float64 { return float64(s.MaxIdleTimeClosed) }},
+	}
+	for _, m := range dbMetrics {
+		writeMetric(b, m.name, m.typ, m.help)
+		for _, k := range keys {
+			fmt.Fprintf(b, "%s{db=\"%s\"} %g\n", m.name, escapeLabel(k), m.value(st.DB[k]))
+		}
+	}
+	return b.Flush()
+}
+
+func writeMetric(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeHistogram(w io.Writer, name, labels string, h Histogram) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, b := range h.Buckets {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%g\"} %d\n", name, labels, sep, b, h.Counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.Count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.Sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.Count)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,66 @@
+package luavm
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPoolStats(t *testing.T) {
+	pool := NewLuaPool()
+
+	vm := pool.Get()
+	if err := vm.DoFile("testdata", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	for _, errNo := range []string{"0101", "0102", "1062", "ER_DUP_ENTRY", ErrNoSuccess} {
+		if _, _, err := vm.DoString(`return "` + errNo + `", "失败"`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st := pool.Stats()
+	if st.Created != 1 || st.InUse != 1 || st.Idle != 0 {
+		t.Fatalf("虚拟机数量统计不符 %+v", st)
+	}
+	if st.Wait.Count != 1 {
+		t.Fatalf("等待次数统计不符[%d]", st.Wait.Count)
+	}
+	if e := st.Execs["testdata/hello"]; e == nil || e.Duration.Count != 1 {
+		t.Fatalf("交易执行统计不符 %+v", e)
+	}
+	if len(st.Errors) != 4 || st.Errors["0101"] != 1 || st.Errors["0102"] != 1 || st.Errors["1062"] != 1 || st.Errors["ER_DUP_ENTRY"] != 1 {
+		t.Fatalf("errNo统计不符 %v", st.Errors)
+	}
+	pool.Put(vm)
+
+	rec := httptest.NewRecorder()
+	pool.StatsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"luavm_pool_created_total 1\n",
+		"luavm_pool_idle 1\n",
+		"luavm_pool_in_use 0\n",
+		"luavm_pool_wait_seconds_count 1\n",
+		`luavm_exec_duration_seconds_count{busi="testdata",trancode="hello"} 1` + "\n",
+		`luavm_exec_errors_total{errno="0101"} 1` + "\n",
+		`luavm_exec_errors_total{errno="ER_DUP_ENTRY"} 1` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("prometheus输出缺少 %q\n%s", want, body)
+		}
+	}
+}
+
+func TestPoolStatsErrnoLimit(t *testing.T) {
+	s := newPoolStats()
+	for i := 0; i < maxErrnos+10; i++ {
+		s.observeExec("", "", 0, fmt.Sprintf("%04d", i+1), nil)
+	}
+	s.observeExec("", "", 0, "0001", nil)
+	var st PoolStats
+	s.copyTo(&st)
+	if len(st.Errors) != maxErrnos+1 || st.Errors["0001"] != 2 || st.Errors[errnoOther] != 10 {
+		t.Fatalf("超出数量的errNo未计入other %d %d %d", len(st.Errors), st.Errors["0001"], st.Errors[errnoOther])
+	}
+}
@@ -0,0 +1,3 @@
+--测试用交易,返回easy.name
+local name = easy.name or "world"
+easy.result = "hello " .. name
@@ -0,0 +1,100 @@
+package luavm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Validate 检查配置: 数据库类型、重复的名称、必填项以及配置文件中未被读取的项,
+// 返回所有问题. 插件读取配置之后调用, 未被任何插件读取的项视为错误
+func (l *luaConfig) Validate() error {
+	var errs []error
+	add := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+	if err := l.Sandbox.check(); err != nil {
+		errs = append(errs, err)
+	}
+
+	var sqls []*sqlConfig
+	if _, err := l.sections.Decode("SQL", &sqls); err != nil {
+		errs = append(errs, err)
+	}
+	names := make(map[string]int, len(sqls))
+	for i, c := range sqls {
+		switch {
+		case c.Name == "":
+			add("SQL[%d].Name: 不能为空", i)
+		default:
+			if j, ok := names[c.Name]; ok {
+				add("SQL[%d].Name: 与SQL[%d]重复[%s]", i, j, c.Name)
+			}
+			names[c.Name] = i
+		}
+		if getDialect(c.Type) == nil {
+			add("SQL[%d].Type: 不支持的数据库类型[%s], 可选 %s", i, c.Type, strings.Join(dialectNames(), ", "))
+		}
+		if c.Addr == "" {
+			add("SQL[%d].Addr: 不能为空", i)
+		}
+		if c.Null != "" && c.Null != "null" && c.Null != "omit" {
+			add("SQL[%d].Null: 不支持的取值[%s], 可选 null, omit", i, c.Null)
+		}
+		if c.Time != "" && c.Time != "iso" && c.Time != "epoch" {
+			add("SQL[%d].Time: 不支持的取值[%s], 可选 iso, epoch", i, c.Time)
+		}
+	}
+
+	redis, _, err := decodeInstances[redisConfig](l.sections, "Redis")
+	if err != nil {
+		errs = append(errs, err)
+	}
+	rs := make([]instanceConfig, len(redis))
+	for i, c := range redis {
+		rs[i] = instanceConfig{c.Name, c.Addr}
+	}
+	errs = append(errs, validateInstances("Redis", rs)...)
+
+	mongo, _, err := decodeInstances[mgoConfig](l.sections, "Mongodb")
+	if err != nil {
+		errs = append(errs, err)
+	}
+	ms := make([]instanceConfig, len(mongo))
+	for i, c := range mongo {
+		ms[i] = instanceConfig{c.Name, c.Addr}
+	}
+	errs = append(errs, validateInstances("Mongodb", ms)...)
+
+	if l.sections != nil {
+		for _, key := range l.sections.md.Undecoded() {
+			add("%s: 未知的配置项", key)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// instanceConfig 命名实例的公共字段
+type instanceConfig struct {
+	name string
+	addr string
+}
+
+// validateInstances 检查[[Redis]]/[[Mongodb]]的名称和地址
+func validateInstances(section string, cs []instanceConfig) (errs []error) {
+	names := make(map[string]int, len(cs))
+	for i, c := range cs {
+		name := c.name
+		if name == "" {
+			name = defaultInstance
+		}
+		if j, ok := names[name]; ok {
+			errs = append(errs, fmt.Errorf("%s[%d].Name: 与%s[%d]重复[%s]", section, i, section, j, name))
+		}
+		names[name] = i
+		if c.addr == "" {
+			errs = append(errs, fmt.Errorf("%s[%d].Addr: 不能为空", section, i))
+		}
+	}
+	return
+}
@@ -0,0 +1,76 @@
+package luavm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	//示例配置文件可以通过检查
+	pool := NewLuaPool()
+	if err := pool.conf.LoadFromFile("lua.conf"); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range pool.plugins {
+		if err := p.Decode(pool.conf.sections); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pool.conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := `
+[Pool]
+MaxActive = 10
+MaxActiv = 10
+
+[[SQL]]
+Name = "main"
+Type = "oracle"
+Addr = "127.0.0.1"
+
+[[SQL]]
+Name = "main"
+Type = "mysql"
+
+[[Redis]]
+Name = "cache"
+Addr = "127.0.0.1:6379"
+
+[[Redis]]
+Name = "cache"
+`
+	pool = NewLuaPool()
+	err := pool.InitFromConf(conf)
+	if err == nil {
+		t.Fatal("错误的配置未报错")
+	}
+	for _, want := range []string{
+		"Pool.MaxActiv: 未知的配置项",
+		"SQL[0].Type: 不支持的数据库类型[oracle]",
+		"SQL[1].Name: 与SQL[0]重复[main]",
+		"SQL[1].Addr: 不能为空",
+		"Redis[1].Name: 与Redis[0]重复[cache]",
+		"Redis[1].Addr: 不能为空",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("缺少错误[%s]\n%v", want, err)
+		}
+	}
+}
+
+func TestSQLInitSkipsOtherTypes(t *testing.T) {
+	sl := newLuaSQL(SQLITE)
+	sl.confs = []*sqlConfig{
+		{Name: "mysql-main", Type: "mysql", Addr: "127.0.0.1:3306"},
+		{Name: "sqlite-main", Type: "sqlite", Addr: ":memory:"},
+	}
+	if err := sl.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+	if _, ok := sl.db["mysql-main"]; ok || len(sl.db) != 1 {
+		t.Fatalf("sqlite插件保存了其他类型的数据库 %v", sl.db)
+	}
+}
@@ -0,0 +1,130 @@
+package luavm
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileStamp 用于判断文件是否变化
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// busiWatcher 轮询一个业务目录下的lua文件
+type busiWatcher struct {
+	busi  string
+	dir   string
+	fsys  fs.FS
+	files map[string]fileStamp
+}
+
+// reloadState 脚本重新加载的次数, 虚拟机创建时记录, 之后有变化的虚拟机需要重建
+type reloadState struct {
+	lock sync.Mutex
+	gen  uint64 //每次发现文件变化加1
+}
+
+func (r *reloadState) current() uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.gen
+}
+
+func (r *reloadState) add() {
+	r.lock.Lock()
+	r.gen++
+	r.lock.Unlock()
+}
+
+// Watch 每隔interval检查一次脚本根目录中busi目录下的lua文件,
+// 文件变化后, 之前创建的虚拟机在取出或归还时销毁并重建, 使OnCreate中加载的模块
+// 和设置的全局变量重新加载. 编译缓存按文件内容自行失效.
+// 重新加载事件通过Logger输出. Shutdown时停止检查
+func (pl *LuaPool) Watch(busi string, interval time.Duration) error {
+	w := &busiWatcher{busi: busi, dir: path.Clean(busi), fsys: pl.fsys}
+	files, err := w.scan()
+	if err != nil {
+		return err
+	}
+	w.files = files
+	go pl.watch(w, interval)
+	return nil
+}
+
+func (pl *LuaPool) watch(w *busiWatcher, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pl.checkReload(w)
+		case <-pl.quit:
+			return
+		}
+	}
+}
+
+// checkReload 比较文件变化, 有变化时使已创建的虚拟机过期
+func (pl *LuaPool) checkReload(w *busiWatcher) {
+	files, err := w.scan()
+	if err != nil {
+		pl.logger.Warn("检查业务[%s]脚本失败: %v", w.busi, err)
+		return
+	}
+	var changed []string
+	for p, st := range files {
+		if old, ok := w.files[p]; !ok || old != st {
+			changed = append(changed, p)
+		}
+	}
+	for p := range w.files {
+		if _, ok := files[p]; !ok {
+			changed = append(changed, p)
+		}
+	}
+	w.files = files
+	if len(changed) == 0 {
+		return
+	}
+	sort.Strings(changed)
+	pl.reload.add()
+	pl.logger.Trace("业务[%s]脚本已重新加载: %s", w.busi, strings.Join(changed, ", "))
+}
+
+// scan 获取目录下所有lua文件的状态
+func (w *busiWatcher) scan() (map[string]fileStamp, error) {
+	files := make(map[string]fileStamp, len(w.files))
+	err := fs.WalkDir(w.fsys, w.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || path.Ext(p) != ".lua" {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		files[p] = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+		return nil
+	})
+	return files, err
+}
+
+// refresh 脚本重新加载之前创建的虚拟机中可能保留旧的模块, 销毁后新建一个
+func (pl *LuaPool) refresh(L *LuaVM) (*LuaVM, error) {
+	if L.gen == pl.reload.current() {
+		return L, nil
+	}
+	pl.destroy(L)
+	return pl.new()
+}
@@ -0,0 +1,85 @@
+package luavm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// testLogger 记录输出的日志
+type testLogger struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) add(format string, a ...interface{}) {
+	l.lock.Lock()
+	l.lines = append(l.lines, fmt.Sprintf(format, a...))
+	l.lock.Unlock()
+}
+
+func (l *testLogger) Error(format string, a ...interface{}) { l.add(format, a...) }
+func (l *testLogger) Warn(format string, a ...interface{})  { l.add(format, a...) }
+func (l *testLogger) Trace(format string, a ...interface{}) { l.add(format, a...) }
+
+func (l *testLogger) count() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.lines)
+}
+
+func TestWatchReload(t *testing.T) {
+	root := t.TempDir()
+	writeScripts(t, root, map[string]string{
+		"busi/util.lua":    `return {value = 1}`,
+		"busi/t1/main.lua": `easy.result = require("util").value`,
+		"busi/t2/main.lua": `easy.result = shared.value`,
+	})
+
+	logger := new(testLogger)
+	pool := NewLuaPool()
+	pool.SetLogger(logger)
+	pool.SetFS(os.DirFS(root))
+	//初始化时设置的全局变量引用了模块
+	pool.OnCreate(func(vm *LuaVM) error {
+		_, _, err := vm.DoString(`shared = require("busi.util")`)
+		return err
+	})
+	defer pool.Shutdown(context.Background())
+	if err := pool.Watch("busi", 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(trancode string, want lua.LNumber) {
+		t.Helper()
+		vm := pool.Get()
+		defer pool.Put(vm)
+		if err := vm.DoFile("busi", trancode); err != nil {
+			t.Fatal(err)
+		}
+		if ret := vm.GetEasyAttr("result"); ret != want {
+			t.Fatalf("%s 返回不符[%v], 期望[%v]", trancode, ret, want)
+		}
+	}
+	run("t1", 1)
+	run("t2", 1)
+
+	writeScripts(t, root, map[string]string{"busi/util.lua": `return {value = 22}`})
+	for i := 0; logger.count() == 0; i++ {
+		if i > 100 {
+			t.Fatal("未检测到脚本变化")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	//归还时保留的模块和OnCreate中的全局变量都应重新加载
+	run("t1", 22)
+	run("t2", 22)
+	if st := pool.Stats(); st.Created != 2 {
+		t.Fatalf("变化之前的虚拟机未重建, 已创建[%d]", st.Created)
+	}
+}